@@ -0,0 +1,33 @@
+package pgtest
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+)
+
+// VerifyChecksums checks the data page checksums of the
+// cluster with pg_checksums, returning an error that
+// describes any mismatches. The cluster must have been
+// created with Options.DataChecksums. Like Snapshot,
+// it shuts down the server for the check and starts it
+// again afterward, closing existing connections.
+func (pg *PG) VerifyChecksums() error {
+	if pg.server != nil {
+		return errShared
+	}
+	pg.closeDB()
+	err := pg.halt(ShutdownFast)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(filepath.Join(pg.inst.bindir, "pg_checksums"), "--check", "-D", pg.dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("pg_checksums: %w\n%s", err, out)
+	}
+	if err1 := pg.launch(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package pgtest
+
+import "testing"
+
+func TestVerifyChecksums(t *testing.T) {
+	pg := StartWith(t, Options{DataChecksums: true})
+	defer pg.Stop()
+
+	_, err := pg.DB().Exec("CREATE TABLE t AS SELECT generate_series(1, 1000) AS n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.VerifyChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = pg.DB().QueryRow("SELECT count(*) FROM t").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Fatalf("t has %d rows, want 1000", n)
+	}
+}
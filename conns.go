@@ -0,0 +1,138 @@
+package pgtest
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A ConnInfo describes a client connection to the server,
+// from pg_stat_activity.
+type ConnInfo struct {
+	PID         int
+	Database    string
+	User        string
+	Application string // application_name
+	State       string // such as "active" or "idle"
+	Query       string // the current or last query
+}
+
+// ActiveConnections returns the client connections to the
+// server, apart from the one it uses to ask. For a PG
+// returned by StartShared, it returns only those to its
+// own database.
+func (pg *PG) ActiveConnections() ([]ConnInfo, error) {
+	q := `
+		SELECT pid, coalesce(datname, ''), coalesce(usename, ''),
+			application_name, coalesce(state, ''), coalesce(query, '')
+		FROM pg_stat_activity
+		WHERE pid <> pg_backend_pid() AND backend_type = 'client backend'`
+	var args []interface{}
+	if pg.server != nil {
+		q += " AND datname = $1"
+		args = append(args, pg.dbname)
+	}
+	q += " ORDER BY pid"
+	var conns []ConnInfo
+	err := pg.srv().withDB(pg.srv().dsn("postgres"), func(db *sql.DB) error {
+		rows, err := db.Query(q, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var c ConnInfo
+			err = rows.Scan(&c.PID, &c.Database, &c.User, &c.Application, &c.State, &c.Query)
+			if err != nil {
+				return err
+			}
+			conns = append(conns, c)
+		}
+		return rows.Err()
+	})
+	return conns, err
+}
+
+// TerminateConnections closes every connection to database db,
+// with pg_terminate_backend, for instance so it can be dropped.
+// DropDB, and Stop for a PG returned by StartShared, call it
+// before dropping a database, in case the code under test
+// left connections open.
+func (pg *PG) TerminateConnections(db string) error {
+	srv := pg.srv()
+	return srv.withDB(srv.dsn("postgres"), func(sdb *sql.DB) error {
+		_, err := sdb.Exec(`
+			SELECT pg_terminate_backend(pid)
+			FROM pg_stat_activity
+			WHERE datname = $1 AND pid <> pg_backend_pid()`, db)
+		if err != nil {
+			return fmt.Errorf("terminate connections: %w", err)
+		}
+		return nil
+	})
+}
+
+// StartConnectionKiller starts terminating client connections
+// every interval, as TerminateConnections does, to check
+// that the code under test recovers from lost connections.
+// For a PG returned by StartShared, it terminates only
+// those to its own database. Calling stop, or Stop,
+// stops it.
+// If an error occurs, the test will fail.
+func (pg *PG) StartConnectionKiller(interval time.Duration) (stop func()) {
+	srv := pg.srv()
+	db, err := sql.Open(pg.driverName(), srv.dsn("postgres"))
+	if err != nil {
+		pg.fatal("open:", err)
+	}
+	db.SetMaxOpenConns(1)
+	q := `
+		SELECT pg_terminate_backend(pid)
+		FROM pg_stat_activity
+		WHERE pid <> pg_backend_pid() AND backend_type = 'client backend'`
+	var args []interface{}
+	if pg.server != nil {
+		q += " AND datname = $1"
+		args = append(args, pg.dbname)
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer db.Close()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+				db.Exec(q, args...) // the server might be restarting
+			}
+		}
+	}()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(quit)
+			<-done
+		})
+	}
+	pg.mu.Lock()
+	pg.killers = append(pg.killers, stop)
+	pg.mu.Unlock()
+	return stop
+}
+
+// stopKillers stops the goroutines
+// started by StartConnectionKiller.
+func (pg *PG) stopKillers() {
+	pg.mu.Lock()
+	killers := pg.killers
+	pg.killers = nil
+	pg.mu.Unlock()
+	for _, stop := range killers {
+		stop()
+	}
+}
@@ -0,0 +1,71 @@
+package pgtest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestActiveConnections(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	url := pg.CreateDB("busy")
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns, err := pg.ActiveConnections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range conns {
+		found = found || c.Database == "busy"
+	}
+	if !found {
+		t.Fatalf("no connection to busy in %+v", conns)
+	}
+
+	// The open connection would make DROP DATABASE fail.
+	pg.DropDB("busy")
+}
+
+func TestConnectionKiller(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	stop := pg.StartConnectionKiller(20 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.PingContext(context.Background()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("connection still alive")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	stop() // harmless
+
+	// The pool replaces the lost connection.
+	err = db.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+package pgtest
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// copyDir copies the file tree rooted at src into
+// directory dst, which must exist, preserving
+// permission bits and symbolic links. It skips src's
+// owner file; dst should have its own, written before
+// the copy, so CleanupStale never sees dst unowned.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == ownerFile {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if rel == "." {
+				return os.Chmod(target, mode.Perm())
+			}
+			err = os.Mkdir(target, mode.Perm())
+			if err != nil {
+				return err
+			}
+			return os.Chmod(target, mode.Perm()) // in spite of umask
+		case mode&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(path, target, mode.Perm())
+		default:
+			return nil // sockets and such; initdb makes none
+		}
+	})
+}
+
+// copyFile copies src to dst, cloning it
+// where the file system allows.
+func copyFile(src, dst string, perm fs.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if cloneFile(w, r) != nil {
+		_, err = io.Copy(w, r)
+	}
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dst, perm)
+}
+
+// initdbSpace is roughly how much disk space initdb needs.
+const initdbSpace = 64 << 20
+
+// checkSpace returns an error if the file system holding
+// dir has less than need bytes free, so that running out
+// is reported clearly, before anything is half written.
+// If the free space can't be found, it returns nil.
+func checkSpace(dir string, need uint64) error {
+	free, ok := diskFree(dir)
+	if ok && free < need {
+		return fmt.Errorf("insufficient disk space in %s: need ~%d MB, have %d MB",
+			dir, need>>20+1, free>>20)
+	}
+	return nil
+}
+
+// dirSize returns the total size of the
+// regular files in the tree rooted at dir.
+func dirSize(dir string) (uint64, error) {
+	var n uint64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		n += uint64(info.Size())
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,146 @@
+package pgtest
+
+import (
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyDir(t *testing.T) {
+	src, err := ioutil.TempDir("", "pgtest-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "pgtest-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	os.Chmod(src, 0700)
+	os.Mkdir(filepath.Join(src, "base"), 0700)
+	ioutil.WriteFile(filepath.Join(src, "PG_VERSION"), []byte("15\n"), 0600)
+	ioutil.WriteFile(filepath.Join(src, "base", "1"), []byte("data"), 0640)
+	os.Symlink("base", filepath.Join(src, "link"))
+	writeOwner(src)
+
+	err = copyDir(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]os.FileMode{
+		".":          os.ModeDir | 0700,
+		"base":       os.ModeDir | 0700,
+		"PG_VERSION": 0600,
+		"base/1":     0640,
+	} {
+		fi, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fi.Mode() != want {
+			t.Errorf("%s: mode = %v, want %v", name, fi.Mode(), want)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dst, "base", "1"))
+	if err != nil || string(b) != "data" {
+		t.Errorf("base/1 = %q, %v; want data", b, err)
+	}
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	if err != nil || link != "base" {
+		t.Errorf("link = %q, %v; want base", link, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, ownerFile)); err == nil {
+		t.Error("owner file copied")
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	dir := t.TempDir()
+	if _, ok := diskFree(dir); !ok {
+		t.Skip("can't find free space here")
+	}
+	err := checkSpace(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkSpace(dir, 1<<62)
+	if err == nil || !strings.Contains(err.Error(), "insufficient disk space") {
+		t.Fatalf("err = %v, want insufficient disk space", err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // several blocks
+	err := ioutil.WriteFile(src, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, "dst")
+	err = copyFile(src, dst, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("copy has %d bytes, differing from the %d of the original", len(b), len(data))
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0640 {
+		t.Fatalf("mode = %v, want %v", fi.Mode(), os.FileMode(0640))
+	}
+}
+
+// TestCopyCluster checks that a copy of initdb's output
+// is exact, whether the files were cloned or copied.
+func TestCopyCluster(t *testing.T) {
+	_, data, err := initCache(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	err = copyDir(data, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	err = filepath.WalkDir(data, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, _ := filepath.Rel(data, path)
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dst, rel))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s differs from the original", rel)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatalf("no files in %s", data)
+	}
+}
@@ -0,0 +1,44 @@
+package pgtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CopyFrom bulk-loads rows into table from r, which holds
+// CSV whose first record names the columns. An empty field,
+// unless quoted, is NULL. It uses COPY, via psql from the same
+// installation as postgres, so it is much faster than INSERT
+// for large fixtures, and loads either all rows or none.
+func (pg *PG) CopyFrom(table string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil && (err != io.EOF || header == "") {
+		return fmt.Errorf("copy %s: header: %w", table, err)
+	}
+	cols, err := csv.NewReader(strings.NewReader(header)).Read()
+	if err != nil {
+		return fmt.Errorf("copy %s: header: %w", table, err)
+	}
+	for i, c := range cols {
+		cols[i] = quoteIdent(c)
+	}
+	q := fmt.Sprintf(`\copy %s (%s) FROM STDIN WITH (FORMAT csv)`, quoteIdent(table), strings.Join(cols, ", "))
+	cmd := exec.Command(filepath.Join(pg.srv().inst.bindir, "psql"),
+		"-X", "-q", "-v", "ON_ERROR_STOP=1", "-d", pg.URL, "-c", q)
+	cmd.Stdin = br
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("copy %s: %w\n%s", table, err, out.Bytes())
+	}
+	return nil
+}
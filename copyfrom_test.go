@@ -0,0 +1,42 @@
+package pgtest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCopyFrom(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: "CREATE TABLE people (id int, name text)"})
+	defer pg.Stop()
+
+	err := pg.CopyFrom("people", strings.NewReader("id,name\n1,alice\n2,\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n, nulls int
+	err = pg.DB().QueryRow("SELECT count(*), count(*) - count(name) FROM people").Scan(&n, &nulls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || nulls != 1 {
+		t.Fatalf("got %d rows with %d nulls, want 2 with 1", n, nulls)
+	}
+}
+
+func TestCopyFromAtomic(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: "CREATE TABLE nums (n int)"})
+	defer pg.Stop()
+
+	err := pg.CopyFrom("nums", strings.NewReader("n\n1\nnot a number\n"))
+	if err == nil {
+		t.Fatal("CopyFrom succeeded, want error")
+	}
+	var n int
+	err = pg.DB().QueryRow("SELECT count(*) FROM nums").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("got %d rows, want 0", n)
+	}
+}
@@ -0,0 +1,291 @@
+package pgtest
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// DB returns a handle to the database at URL, opening it
+// on first use. Later calls return the same handle.
+// It is closed by Stop.
+// If an error occurs, the test will fail.
+func (pg *PG) DB() *sql.DB {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if pg.db == nil {
+		db, err := sql.Open(pg.driverName(), pg.URL)
+		if err != nil {
+			pg.fatal("open:", err)
+		}
+		err = db.Ping()
+		if err != nil {
+			db.Close()
+			pg.fatal("ping:", pg.connError(err))
+		}
+		pg.db = db
+	}
+	return pg.db
+}
+
+// QueryRow runs query on DB and returns
+// at most one row, as sql.DB.QueryRow does.
+func (pg *PG) QueryRow(query string, args ...interface{}) *sql.Row {
+	return pg.DB().QueryRow(query, args...)
+}
+
+// Exec runs query on DB without returning rows,
+// as sql.DB.Exec does.
+func (pg *PG) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return pg.DB().Exec(query, args...)
+}
+
+// Setting returns the current value of the server
+// setting name, as SHOW does, on a connection from DB.
+func (pg *PG) Setting(name string) (string, error) {
+	var v string
+	err := pg.DB().QueryRow("SELECT current_setting($1)", name).Scan(&v)
+	return v, err
+}
+
+// SetReadOnly sets default_transaction_read_only, so that
+// transactions reject writes unless they ask for READ WRITE,
+// as on a hot standby. On a server of its own, it applies
+// to existing connections too, once they see the server's
+// configuration reload, usually before their next statement.
+// For a PG returned by StartShared, it applies only to
+// connections to its database made afterward.
+func (pg *PG) SetReadOnly(readOnly bool) error {
+	v := "off"
+	if readOnly {
+		v = "on"
+	}
+	if pg.server != nil {
+		return pg.server.exec("postgres", "ALTER DATABASE "+quoteIdent(pg.dbname)+
+			" SET default_transaction_read_only = "+v)
+	}
+	return pg.withDB(pg.dsn("postgres"), func(db *sql.DB) error {
+		_, err := db.Exec("ALTER SYSTEM SET default_transaction_read_only = " + v)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("SELECT pg_reload_conf()")
+		return err
+	})
+}
+
+// connError adds a hint to err if it says
+// the server has too many connections.
+func (pg *PG) connError(err error) error {
+	if sqlState(err) != "53300" {
+		return err
+	}
+	if n := pg.srv().maxConns; n > 0 {
+		return fmt.Errorf("%w (Options.MaxConnections is %d)", err, n)
+	}
+	return fmt.Errorf("%w (raise the limit with Options.MaxConnections)", err)
+}
+
+// sqlState returns the SQLSTATE code of err, if it
+// is an error from the server, or else "". Both lib/pq
+// and pgx give their errors a SQLState method.
+func sqlState(err error) string {
+	var se interface{ SQLState() string }
+	if errors.As(err, &se) {
+		return se.SQLState()
+	}
+	return ""
+}
+
+func (pg *PG) closeDB() {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if pg.db != nil {
+		pg.db.Close()
+		pg.db = nil
+	}
+}
+
+// Tx begins a transaction on DB and arranges for it to be
+// rolled back when t and its subtests finish, so that
+// nothing the test does lasts beyond it. With StartShared,
+// this makes for cheap isolation between tests.
+//
+// The code under test must do all its work through the
+// returned *sql.Tx. Anything done on another connection
+// is outside the transaction and is not rolled back.
+func (pg *PG) Tx(t testing.TB) *sql.Tx {
+	tx, err := pg.DB().Begin()
+	if err != nil {
+		t.Fatal("begin:", err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+	return tx
+}
+
+// Savepoint makes a savepoint called name in tx, such as
+// one from Tx, and returns a function that rolls tx back
+// to it and releases it, undoing whatever was done in tx
+// since. This gives each level of nested subtests its own
+// rollback point within the one transaction:
+//
+//	tx := pg.Tx(t)
+//	t.Run("sub", func(t *testing.T) {
+//		t.Cleanup(pg.Savepoint(t, tx, "sub"))
+//		// ...
+//	})
+//
+// If an error occurs, t will fail.
+func (pg *PG) Savepoint(t testing.TB, tx *sql.Tx, name string) func() {
+	name = quoteIdent(name)
+	_, err := tx.Exec("SAVEPOINT " + name)
+	if err != nil {
+		t.Fatal("savepoint:", err)
+	}
+	return func() {
+		_, err := tx.Exec("ROLLBACK TO SAVEPOINT " + name)
+		if err == nil {
+			_, err = tx.Exec("RELEASE SAVEPOINT " + name)
+		}
+		if err != nil {
+			t.Fatal("rollback to savepoint:", err)
+		}
+	}
+}
+
+// CreateDB creates a new, empty database on the server
+// and returns a connection URL for it. The database is
+// dropped by Stop, if DropDB hasn't dropped it already.
+// If an error occurs, the test will fail.
+func (pg *PG) CreateDB(name string) string {
+	srv := pg.srv()
+	err := srv.createDB(name, "")
+	if err != nil {
+		pg.fatal(err)
+	}
+	pg.mu.Lock()
+	pg.created = append(pg.created, name)
+	pg.mu.Unlock()
+	return pg.withAppName(srv.dsn(name))
+}
+
+// DropDB drops database name, made by CreateDB.
+// If an error occurs, the test will fail.
+func (pg *PG) DropDB(name string) {
+	err := pg.srv().dropDB(name)
+	if err != nil {
+		pg.fatal(err)
+	}
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	for i, s := range pg.created {
+		if s == name {
+			pg.created = append(pg.created[:i], pg.created[i+1:]...)
+			break
+		}
+	}
+}
+
+// srv returns the server pg's database is on.
+func (pg *PG) srv() *PG {
+	if pg.server != nil {
+		return pg.server
+	}
+	return pg
+}
+
+func (pg *PG) dropDB(name string) error {
+	err := pg.TerminateConnections(name)
+	if err != nil {
+		return err
+	}
+	err = pg.exec("postgres", "DROP DATABASE "+quoteIdent(name))
+	if err != nil {
+		return fmt.Errorf("drop database: %w", err)
+	}
+	return nil
+}
+
+// Reset empties every table in the public schema of the
+// database at URL, and restarts their sequences, leaving
+// the schema itself intact. It is much faster than
+// stopping and starting a new server.
+// If an error occurs, the test will fail.
+func (pg *PG) Reset() {
+	err := pg.withDB(pg.URL, reset)
+	if err != nil {
+		pg.fatal("reset:", err)
+	}
+}
+
+func reset(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT quote_ident(schemaname) || '.' || quote_ident(tablename)
+		FROM pg_tables
+		WHERE schemaname = 'public'
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		tables = append(tables, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	_, err = db.Exec("TRUNCATE " + strings.Join(tables, ", ") + " RESTART IDENTITY CASCADE")
+	return err
+}
+
+// OffsetSequences sets every sequence in the public schema
+// of the database at URL to issue start next, to catch
+// code that assumes IDs are small. It fails if start is
+// beyond a sequence's maximum, such as 2147483647 for one
+// made for a serial column. Reset restarts the sequences,
+// so call it again after Reset.
+// If an error occurs, the test will fail.
+func (pg *PG) OffsetSequences(start int64) {
+	err := pg.withDB(pg.URL, func(db *sql.DB) error {
+		_, err := db.Exec(`
+			SELECT setval(c.oid, $1, false)
+			FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.relkind = 'S' AND n.nspname = 'public'
+		`, start)
+		return err
+	})
+	if err != nil {
+		pg.fatal("offset sequences:", err)
+	}
+}
+
+// Analyze runs ANALYZE on each of tables, or on the whole
+// database at URL if there are none, so the planner has
+// statistics for tests that check query plans, rather
+// than waiting for autovacuum to gather them.
+// Table names are as written in SQL, such as "public.t".
+func (pg *PG) Analyze(tables ...string) error {
+	return pg.withDB(pg.URL, func(db *sql.DB) error {
+		if len(tables) == 0 {
+			_, err := db.Exec("ANALYZE")
+			return err
+		}
+		for _, t := range tables {
+			_, err := db.Exec("ANALYZE " + t)
+			if err != nil {
+				return fmt.Errorf("analyze %s: %w", t, err)
+			}
+		}
+		return nil
+	})
+}
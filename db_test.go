@@ -0,0 +1,294 @@
+package pgtest
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestReset(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: `
+		CREATE TABLE a (id serial PRIMARY KEY);
+		CREATE TABLE b (id serial PRIMARY KEY, a int REFERENCES a);
+		INSERT INTO a DEFAULT VALUES;
+		INSERT INTO b (a) VALUES (1);
+	`})
+	defer pg.Stop()
+
+	pg.Reset()
+
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	defer db.Close()
+	var n int
+	err = db.QueryRow("SELECT count(*) FROM a").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("after Reset, a has %d rows, want 0", n)
+	}
+	var id int
+	err = db.QueryRow("INSERT INTO a DEFAULT VALUES RETURNING id").Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Fatalf("after Reset, new id = %d, want 1", id)
+	}
+}
+
+func TestDB(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	db := pg.DB()
+	if pg.DB() != db {
+		t.Fatal("DB returned a different handle on second call")
+	}
+	var n int
+	err := db.QueryRow("SELECT 1").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTx(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: "CREATE TABLE t (x int)"})
+	defer pg.Stop()
+
+	t.Run("insert", func(t *testing.T) {
+		tx := pg.Tx(t)
+		_, err := tx.Exec("INSERT INTO t VALUES (1)")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	var n int
+	err := pg.DB().QueryRow("SELECT count(*) FROM t").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("after rollback, t has %d rows, want 0", n)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	pg := StartWith(t, Options{MaxConnections: 20})
+	defer pg.Stop()
+
+	var n int
+	err := pg.DB().QueryRow("SHOW max_connections").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Fatalf("max_connections = %d, want 20", n)
+	}
+	err = pg.connError(&pq.Error{Code: "53300", Message: "sorry, too many clients already"})
+	if !strings.Contains(err.Error(), "MaxConnections is 20") {
+		t.Fatalf("connError = %v, want mention of the limit", err)
+	}
+}
+
+// stateDriver is a database/sql driver whose every
+// statement fails with an error carrying a SQLSTATE,
+// the way drivers other than pq report them.
+type stateDriver struct{ code string }
+
+type stateError struct{ code string }
+
+func (e stateError) Error() string    { return "server error " + e.code }
+func (e stateError) SQLState() string { return e.code }
+
+func (d stateDriver) Open(string) (driver.Conn, error) { return d, nil }
+
+func (d stateDriver) Prepare(string) (driver.Stmt, error) { return nil, stateError{d.code} }
+func (d stateDriver) Close() error                        { return nil }
+func (d stateDriver) Begin() (driver.Tx, error)           { return nil, stateError{d.code} }
+
+func init() {
+	sql.Register("pgtest-53300", stateDriver{"53300"})
+	sql.Register("pgtest-58P01", stateDriver{"58P01"})
+}
+
+func TestOtherDriverErrors(t *testing.T) {
+	pg := &PG{driver: "pgtest-53300", URL: "ignored", maxConns: 7}
+	err := pg.withDB(pg.URL, func(db *sql.DB) error {
+		_, err := db.Exec("SELECT 1")
+		return pg.connError(err)
+	})
+	if !strings.Contains(fmt.Sprint(err), "MaxConnections is 7") {
+		t.Errorf("connError = %v, want mention of the limit", err)
+	}
+
+	db, err := sql.Open("pgtest-58P01", "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = createExtensions(db, []string{"nonesuch"})
+	if !strings.Contains(fmt.Sprint(err), "is not installed") {
+		t.Errorf("createExtensions = %v, want not installed", err)
+	}
+}
+
+func TestQueryRowExec(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: "CREATE TABLE t (n int)"})
+	defer pg.Stop()
+
+	_, err := pg.Exec("INSERT INTO t VALUES ($1), ($2)", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum int
+	err = pg.QueryRow("SELECT sum(n) FROM t").Scan(&sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 3 {
+		t.Fatalf("sum = %d, want 3", sum)
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: "CREATE TABLE t (n int)"})
+	defer pg.Stop()
+
+	err := pg.SetReadOnly(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("INSERT INTO t VALUES (1)")
+	if err == nil || !strings.Contains(err.Error(), "read-only") {
+		t.Fatalf("err = %v, want read-only transaction error", err)
+	}
+	err = pg.SetReadOnly(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	_, err = db2.Exec("INSERT INTO t VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetting(t *testing.T) {
+	pg := StartWith(t, Options{Config: map[string]string{"work_mem": "5MB"}})
+	defer pg.Stop()
+
+	v, err := pg.Setting("work_mem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "5MB" {
+		t.Fatalf("work_mem = %q, want 5MB", v)
+	}
+	_, err = pg.Setting("no_such_setting")
+	if err == nil {
+		t.Fatal("Setting(no_such_setting) succeeded, want error")
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: "CREATE TABLE t (n int)"})
+	defer pg.Stop()
+
+	count := func(t *testing.T, tx *sql.Tx) int {
+		var n int
+		err := tx.QueryRow("SELECT count(*) FROM t").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	tx := pg.Tx(t)
+	_, err := tx.Exec("INSERT INTO t VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("sub", func(t *testing.T) {
+		t.Cleanup(pg.Savepoint(t, tx, "sub"))
+		_, err := tx.Exec("INSERT INTO t VALUES (2)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, tx); n != 2 {
+			t.Fatalf("in subtest, t has %d rows, want 2", n)
+		}
+	})
+	if n := count(t, tx); n != 1 {
+		t.Fatalf("after subtest, t has %d rows, want 1", n)
+	}
+}
+
+func TestOffsetSequences(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: `
+		CREATE TABLE a (id bigserial PRIMARY KEY);
+		INSERT INTO a DEFAULT VALUES;
+	`})
+	defer pg.Stop()
+
+	pg.Reset()
+	pg.OffsetSequences(1 << 40)
+
+	var id int64
+	err := pg.QueryRow("INSERT INTO a DEFAULT VALUES RETURNING id").Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1<<40 {
+		t.Fatalf("new id = %d, want %d", id, int64(1<<40))
+	}
+}
+
+func TestAutoAnalyze(t *testing.T) {
+	pg := StartWith(t, Options{
+		AutoAnalyze: true,
+		SchemaSQL: `
+			CREATE TABLE t (n int);
+			INSERT INTO t SELECT generate_series(1, 1000);
+		`,
+	})
+	defer pg.Stop()
+
+	var n int
+	err := pg.QueryRow("SELECT count(*) FROM pg_stats WHERE tablename = 't'").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("no statistics for t after AutoAnalyze")
+	}
+}
+
+func TestAnalyzeTable(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: "CREATE TABLE t (n int)"})
+	defer pg.Stop()
+
+	err := pg.Analyze("public.t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.Analyze("nonesuch")
+	if err == nil {
+		t.Fatal("Analyze(nonesuch) succeeded, want error")
+	}
+}
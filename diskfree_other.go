@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package pgtest
+
+// diskFree can't tell here, so reports false.
+func diskFree(dir string) (uint64, bool) {
+	return 0, false
+}
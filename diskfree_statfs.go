@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package pgtest
+
+import "syscall"
+
+// diskFree returns the number of bytes available
+// to an unprivileged user on the file system holding dir.
+func diskFree(dir string) (uint64, bool) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, false
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), true
+}
@@ -0,0 +1,78 @@
+package pgtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// restore loads the pg_dump archive in file
+// into the database at pg.URL.
+func (pg *PG) restore(file string) error {
+	bindir := pg.srv().inst.bindir
+	var cmd *exec.Cmd
+	if isArchive(file) {
+		cmd = exec.Command(filepath.Join(bindir, "pg_restore"),
+			"--exit-on-error", "--no-owner", "-d", pg.URL, file)
+	} else {
+		cmd = exec.Command(filepath.Join(bindir, "psql"),
+			"-X", "-q", "-v", "ON_ERROR_STOP=1", "-d", pg.URL, "-f", file)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w\n%s", filepath.Base(cmd.Path), err, out)
+	}
+	return nil
+}
+
+// isArchive reports whether file is a pg_dump archive
+// in directory or custom format, rather than plain SQL.
+func isArchive(file string) bool {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+	if fi.IsDir() {
+		return true
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 5)
+	_, err = io.ReadFull(f, magic)
+	return err == nil && bytes.Equal(magic, []byte("PGDMP"))
+}
+
+// Dump writes the schema and data of pg's database to w
+// as plain SQL, using pg_dump from the same installation
+// as postgres. The output is suitable for comparing
+// against a golden file, or for use as Options.DumpFile.
+func (pg *PG) Dump(w io.Writer) error {
+	return pg.dump(w, "plain")
+}
+
+// DumpArchive is like Dump, but writes a pg_dump
+// custom format archive, to be restored with pg_restore
+// or Options.DumpFile.
+func (pg *PG) DumpArchive(w io.Writer) error {
+	return pg.dump(w, "custom")
+}
+
+func (pg *PG) dump(w io.Writer, format string) error {
+	bindir := pg.srv().inst.bindir
+	var stderr bytes.Buffer
+	cmd := exec.Command(filepath.Join(bindir, "pg_dump"),
+		"--no-owner", "--format="+format, "-d", pg.URL)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("pg_dump: %w\n%s", err, stderr.Bytes())
+	}
+	return nil
+}
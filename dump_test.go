@@ -0,0 +1,81 @@
+package pgtest
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpFile(t *testing.T) {
+	pg := StartWith(t, Options{DumpFile: "testdata/dump.sql"})
+	defer pg.Stop()
+
+	var n int
+	err := pg.DB().QueryRow("SELECT count(*) FROM widgets").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("widgets has %d rows, want 2", n)
+	}
+}
+
+func TestIsArchive(t *testing.T) {
+	if isArchive("testdata/dump.sql") {
+		t.Error("plain SQL dump reported as archive")
+	}
+	if !isArchive("testdata") {
+		t.Error("directory not reported as archive")
+	}
+}
+
+func TestDump(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	_, err := pg.DB().Exec("CREATE TABLE dumped (id int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = pg.Dump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "CREATE TABLE public.dumped") {
+		t.Fatalf("dump missing table:\n%s", buf.String())
+	}
+}
+
+func TestDumpArchive(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	_, err := pg.DB().Exec("CREATE TABLE dumped (id int); INSERT INTO dumped VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "dump")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.DumpArchive(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pg2 := StartWith(t, Options{DumpFile: file})
+	defer pg2.Stop()
+	var n int
+	err = pg2.DB().QueryRow("SELECT count(*) FROM dumped").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("dumped has %d rows, want 1", n)
+	}
+}
@@ -0,0 +1,43 @@
+package pgtest
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Env returns environment variables, in the form
+// "key=value", that point libpq-based tools such as
+// psql and pg_dump at pg's database, for use in
+// exec.Cmd.Env. PGDATA names the data directory.
+func (pg *PG) Env() []string {
+	srv := pg.srv()
+	env := []string{
+		"PGHOST=" + srv.host,
+		"PGDATABASE=" + pg.dbname,
+		"PGUSER=" + srv.user,
+		"PGSSLMODE=disable",
+		"PGDATA=" + srv.dir,
+	}
+	if srv.port != 0 {
+		env = append(env, "PGPORT="+strconv.Itoa(srv.port))
+	}
+	if srv.password != "" {
+		env = append(env, "PGPASSWORD="+srv.password)
+	}
+	return env
+}
+
+// SetEnv sets the variables from Env in the
+// environment of the current process, so that
+// it and any commands it runs use pg by default.
+func (pg *PG) SetEnv() error {
+	for _, kv := range pg.Env() {
+		i := strings.IndexByte(kv, '=')
+		err := os.Setenv(kv[:i], kv[i+1:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
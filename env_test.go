@@ -0,0 +1,24 @@
+package pgtest
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnv(t *testing.T) {
+	pg := StartWith(t, Options{DBName: "envdb"})
+	defer pg.Stop()
+
+	cmd := exec.Command(filepath.Join(pg.inst.bindir, "psql"), "-X", "-Atc", "SELECT current_database()")
+	cmd.Env = append(os.Environ(), pg.Env()...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("psql: %v\n%s", err, out)
+	}
+	if got := strings.TrimSpace(string(out)); got != "envdb" {
+		t.Fatalf("current_database() = %q, want envdb", got)
+	}
+}
@@ -0,0 +1,350 @@
+package pgtest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An install is a PostgreSQL installation.
+type install struct {
+	bindir   string
+	postgres string
+	initdb   string
+	pgctl    string
+	version  string // of postgres, such as "15.4"
+}
+
+var cleanupOnce sync.Once
+
+var (
+	installMu sync.Mutex
+	installs  = make(map[string]*installResult) // by Options.BinDir
+)
+
+type installResult struct {
+	once sync.Once
+	inst *install
+	err  error
+}
+
+var (
+	cacheMu sync.Mutex
+	caches  = make(map[string]*cache) // by directory
+)
+
+// A cache is a directory holding the output of initdb,
+// to be copied for each new server.
+type cache struct {
+	once sync.Once
+	err  error
+}
+
+// initCache returns the installation to use for opts
+// and the directory of its cached initdb output,
+// running initdb if need be.
+func initCache(opts Options) (*install, string, error) {
+	cleanupOnce.Do(func() { CleanupStale() })
+	inst, err := findInstall(opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if passwordAuth[opts.AuthMethod] && opts.Password == "" {
+		return nil, "", fmt.Errorf("AuthMethod %s needs a Password", opts.AuthMethod)
+	}
+	args := initdbArgs(opts)
+	key := append([]string{inst.postgres}, args...)
+	if opts.Password != "" {
+		key = append(key, "password="+opts.Password)
+	}
+	base := cacheBase(opts)
+	err = os.MkdirAll(base, 0700)
+	if err != nil {
+		return nil, "", err
+	}
+	dir := cacheDir(base, inst.version, key...)
+	cacheMu.Lock()
+	c := caches[dir]
+	if c == nil {
+		c = new(cache)
+		caches[dir] = c
+	}
+	cacheMu.Unlock()
+	// Once returns only after the first call is done,
+	// so nobody reads dir before initdb has finished.
+	c.once.Do(func() { c.err = maybeInitdb(inst, dir, args, opts.Password) })
+	return inst, dir, c.err
+}
+
+// findInstall returns the installation in opts.BinDir,
+// or else $PGTEST_BINDIR, or else the one pg_config
+// reports, looking it up on first use.
+func findInstall(opts Options) (*install, error) {
+	bindir := opts.BinDir
+	if bindir == "" {
+		bindir = os.Getenv("PGTEST_BINDIR")
+	}
+	installMu.Lock()
+	r := installs[bindir]
+	if r == nil {
+		r = new(installResult)
+		installs[bindir] = r
+	}
+	installMu.Unlock()
+	r.once.Do(func() { r.inst, r.err = findPostgres(bindir) })
+	return r.inst, r.err
+}
+
+// findPostgres locates the postgres and initdb binaries
+// in bindir, or if bindir is empty, using pg_config.
+func findPostgres(bindir string) (*install, error) {
+	from := "the bindir reported by pg_config"
+	if bindir != "" {
+		from = "the given bindir"
+	} else {
+		out, err := exec.Command("pg_config", "--bindir").Output()
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("%w: install it "+
+				"(brew install postgresql / apt-get install postgresql) "+
+				"and ensure pg_config is on PATH", ErrPostgresNotFound)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pg_config: %w", err)
+		}
+		bindir = string(bytes.TrimSpace(out))
+	}
+	inst := &install{
+		bindir:   bindir,
+		postgres: filepath.Join(bindir, "postgres"),
+		initdb:   filepath.Join(bindir, "initdb"),
+		pgctl:    filepath.Join(bindir, "pg_ctl"),
+	}
+	for _, bin := range []string{inst.postgres, inst.initdb} {
+		if _, err := exec.LookPath(bin); err != nil {
+			// Some packages, such as Debian's libpq-dev,
+			// install pg_config without the server.
+			return nil, fmt.Errorf("%w: %s not found in %s, %s; "+
+				"is the PostgreSQL server installed?", ErrPostgresNotFound, filepath.Base(bin), bindir, from)
+		}
+	}
+	out, err := exec.Command(inst.postgres, "--version").Output()
+	if err != nil {
+		return nil, fmt.Errorf("postgres --version: %w", err)
+	}
+	inst.version, err = parseVersion(string(out))
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// initdbArgs returns the initdb flags for opts.
+func initdbArgs(opts Options) []string {
+	var args []string
+	if opts.Encoding != "" {
+		args = append(args, "--encoding="+opts.Encoding)
+	}
+	if opts.Locale != "" {
+		args = append(args, "--locale="+opts.Locale)
+	}
+	if opts.DataChecksums {
+		args = append(args, "--data-checksums")
+	}
+	args = append(args, "--username="+superuser(opts))
+	if opts.AuthMethod != "" {
+		args = append(args, "--auth="+opts.AuthMethod)
+	}
+	return append(args, opts.InitdbArgs...)
+}
+
+// passwordAuth holds the authentication
+// methods that check a password.
+var passwordAuth = map[string]bool{
+	"scram-sha-256": true,
+	"md5":           true,
+	"password":      true,
+}
+
+// defaultSuperuser is the superuser's name if
+// Options.Superuser is empty. A fixed name, rather
+// than initdb's default of the current OS user, means
+// tests see the same owner on every machine.
+const defaultSuperuser = "postgres"
+
+func superuser(opts Options) string {
+	if opts.Superuser != "" {
+		return opts.Superuser
+	}
+	return defaultSuperuser
+}
+
+// maybeInitdb runs initdb with args in dir,
+// unless dir already exists. If password is set,
+// it becomes the superuser's password.
+// It builds the cluster in a temporary directory
+// and renames it into place, so no other process
+// ever sees dir partly written.
+func maybeInitdb(inst *install, dir string, args []string, password string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	// Other processes, such as the test binaries of
+	// other packages, may want the same directory.
+	// One runs initdb while the rest wait.
+	unlock, err := lockFile(dir + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(dir); err == nil {
+		return nil // made while we waited
+	}
+	err = checkSpace(filepath.Dir(dir), initdbSpace)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+"-tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp) // no-op once renamed
+	if password != "" {
+		f, err := ioutil.TempFile("", "pgtest-pw")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = io.WriteString(f, password+"\n")
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return err
+		}
+		args = append(args, "--pwfile="+f.Name())
+	}
+	out, err := exec.Command(inst.initdb, append([]string{"-D", tmp}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %w\n%s", ErrInitdbFailed, err, out)
+	}
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		if _, err1 := os.Stat(dir); err1 == nil {
+			return nil // another process got there first
+		}
+		return err
+	}
+	return nil
+}
+
+// cacheDir returns the directory for initdb output
+// made with the given settings. Each distinct postgres
+// binary and version gets its own directory, so a cluster
+// made by one version is never handed to another.
+func cacheDir(base, version string, key ...string) string {
+	h := sha256.New()
+	for _, s := range key {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	name := fmt.Sprintf("pgtestdata1-%s-%x", version, h.Sum(nil)[:6])
+	return filepath.Join(base, name)
+}
+
+// cacheBase returns the directory to keep initdb output in:
+// opts.CacheDir, or else $PGTEST_CACHE, or else a directory
+// in tempBase belonging to the current user, so that users
+// sharing a machine don't trip over each other's files.
+func cacheBase(opts Options) string {
+	if opts.CacheDir != "" {
+		return opts.CacheDir
+	}
+	if s := os.Getenv("PGTEST_CACHE"); s != "" {
+		return s
+	}
+	name := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		name = u.Username
+	}
+	return filepath.Join(tempBase(opts), "pgtest-cache-"+safeName(name))
+}
+
+// tempBase returns the directory for temporary files:
+// opts.TempDir, or else $PGTEST_TMPDIR, or else os.TempDir.
+func tempBase(opts Options) string {
+	if opts.TempDir != "" {
+		return opts.TempDir
+	}
+	if s := os.Getenv("PGTEST_TMPDIR"); s != "" {
+		return s
+	}
+	return os.TempDir()
+}
+
+// safeName replaces any characters in s
+// that might be trouble in a file name.
+func safeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// parseVersion extracts the version number
+// from the output of postgres --version,
+// for example "postgres (PostgreSQL) 15.4".
+func parseVersion(s string) (string, error) {
+	const prefix = "(PostgreSQL) "
+	i := strings.Index(s, prefix)
+	if i < 0 {
+		return "", fmt.Errorf("unrecognized postgres version %q", s)
+	}
+	f := strings.Fields(s[i+len(prefix):])
+	if len(f) == 0 {
+		return "", fmt.Errorf("unrecognized postgres version %q", s)
+	}
+	return f[0], nil
+}
+
+// checkLibraries returns an error naming the first of libs
+// not found in inst's pkglibdir. If pg_config is missing
+// from inst's bindir, it leaves the check to postgres.
+func checkLibraries(inst *install, libs []string) error {
+	out, err := exec.Command(filepath.Join(inst.bindir, "pg_config"), "--pkglibdir").Output()
+	if err != nil {
+		return nil
+	}
+	libdir := string(bytes.TrimSpace(out))
+	for _, lib := range libs {
+		dir, name := libdir, strings.TrimPrefix(lib, "$libdir/")
+		if filepath.IsAbs(name) {
+			dir, name = filepath.Split(name)
+		}
+		if !hasLibrary(dir, name) {
+			return fmt.Errorf("preload library %s not found in %s", lib, dir)
+		}
+	}
+	return nil
+}
+
+func hasLibrary(dir, name string) bool {
+	for _, ext := range []string{"", ".so", ".dylib", ".dll"} {
+		if _, err := os.Stat(filepath.Join(dir, name+ext)); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package pgtest
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheDirDistinct(t *testing.T) {
+	a := cacheDir("/tmp", "15.4", "/usr/bin/postgres")
+	b := cacheDir("/tmp", "15.4", "/usr/bin/postgres", "--locale=C")
+	c := cacheDir("/tmp", "15.4", "/usr/bin/postgres", "--locale=en_US.UTF-8")
+	if a == b || b == c || a == c {
+		t.Errorf("cache dirs not distinct: %s %s %s", a, b, c)
+	}
+}
+
+func TestCacheBase(t *testing.T) {
+	if got := cacheBase(Options{CacheDir: "/a"}); got != "/a" {
+		t.Errorf("cacheBase with CacheDir = %q, want /a", got)
+	}
+	os.Setenv("PGTEST_CACHE", "/b")
+	defer os.Unsetenv("PGTEST_CACHE")
+	if got := cacheBase(Options{}); got != "/b" {
+		t.Errorf("cacheBase with PGTEST_CACHE = %q, want /b", got)
+	}
+}
+
+func TestSafeName(t *testing.T) {
+	if got := safeName(`DOMAIN\some user`); got != "DOMAIN_some_user" {
+		t.Errorf("safeName = %q, want DOMAIN_some_user", got)
+	}
+}
+
+func TestLocale(t *testing.T) {
+	pg := StartWith(t, Options{Encoding: "UTF8", Locale: "C"})
+	defer pg.Stop()
+
+	var collate string
+	err := pg.DB().QueryRow("SELECT datcollate FROM pg_database WHERE datname = current_database()").Scan(&collate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collate != "C" {
+		t.Fatalf("datcollate = %q, want C", collate)
+	}
+}
+
+func TestStartConcurrent(t *testing.T) {
+	const n = 16
+	pgs := make([]*PG, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range pgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pgs[i], errs[i] = StartErr("")
+		}(i)
+	}
+	wg.Wait()
+	for i, pg := range pgs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		defer pg.Stop()
+	}
+	for i, pg := range pgs {
+		db := pg.DB()
+		_, err := db.Exec("CREATE TABLE t (x int)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO t VALUES ($1)", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, pg := range pgs {
+		var x int
+		err := pg.DB().QueryRow("SELECT x FROM t").Scan(&x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x != i {
+			t.Errorf("instance %d: x = %d, want %d", i, x, i)
+		}
+	}
+}
+
+func TestInitdbArgs(t *testing.T) {
+	opts := Options{Locale: "C", InitdbArgs: []string{"--data-checksums"}}
+	got := initdbArgs(opts)
+	want := []string{"--locale=C", "--username=postgres", "--data-checksums"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("initdbArgs = %q, want %q", got, want)
+	}
+}
+
+func TestHasLibrary(t *testing.T) {
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "plugin.so"), nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasLibrary(dir, "plugin") {
+		t.Error("hasLibrary(plugin) = false, want true")
+	}
+	if hasLibrary(dir, "missing") {
+		t.Error("hasLibrary(missing) = true, want false")
+	}
+}
+
+func TestFindPostgresNotFound(t *testing.T) {
+	_, err := findPostgres(t.TempDir())
+	if !errors.Is(err, ErrPostgresNotFound) {
+		t.Fatalf("err = %v, want ErrPostgresNotFound", err)
+	}
+}
+
+// TestInitCacheHelper is run in child processes
+// by TestInitCacheProcesses.
+func TestInitCacheHelper(t *testing.T) {
+	dir := os.Getenv("PGTEST_HELPER_CACHE")
+	if dir == "" {
+		return
+	}
+	_, _, err := initCache(Options{CacheDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInitCacheProcesses(t *testing.T) {
+	dir := t.TempDir()
+	const n = 4
+	cmds := make([]*exec.Cmd, n)
+	outs := make([]bytes.Buffer, n)
+	for i := range cmds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestInitCacheHelper$")
+		cmd.Env = append(os.Environ(), "PGTEST_HELPER_CACHE="+dir)
+		cmd.Stdout = &outs[i]
+		cmd.Stderr = &outs[i]
+		err := cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds[i] = cmd
+	}
+	for i, cmd := range cmds {
+		err := cmd.Wait()
+		if err != nil {
+			t.Errorf("process %d: %v\n%s", i, err, outs[i].Bytes())
+		}
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "pgtestdata1-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".lock") {
+			dirs = append(dirs, filepath.Base(name))
+		}
+	}
+	if len(dirs) != 1 {
+		t.Fatalf("cache has %q, want one directory", dirs)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan bool)
+	go func() {
+		unlock2, err := lockFile(path)
+		if err == nil {
+			unlock2()
+		}
+		locked <- err == nil
+	}()
+	select {
+	case <-locked:
+		t.Fatal("second lockFile did not wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	if !<-locked {
+		t.Fatal("second lockFile failed")
+	}
+}
@@ -0,0 +1,60 @@
+package pgtest
+
+import "context"
+
+// An Option sets a field of Options, for New.
+// Any func(*Options) will do, for settings
+// not covered by the With functions here.
+type Option func(*Options)
+
+// New is like StartErr, with a temporary directory
+// chosen as it does, but with the settings made by opts,
+// applied in order to the zero Options.
+func New(opts ...Option) (*PG, error) {
+	return start(context.Background(), "", newOptions(opts))
+}
+
+func newOptions(opts []Option) Options {
+	var o Options
+	for _, f := range opts {
+		f(&o)
+	}
+	return o
+}
+
+// WithDBName sets Options.DBName.
+func WithDBName(name string) Option {
+	return func(o *Options) { o.DBName = name }
+}
+
+// WithSchema sets Options.SchemaSQL.
+func WithSchema(sql string) Option {
+	return func(o *Options) { o.SchemaSQL = sql }
+}
+
+// WithTCP sets Options.ListenTCP, and Options.Port
+// to port; zero means pick a free one.
+func WithTCP(port int) Option {
+	return func(o *Options) {
+		o.ListenTCP = true
+		o.Port = port
+	}
+}
+
+// WithConfig adds the settings in config to Options.Config,
+// replacing any already there with the same name.
+func WithConfig(config map[string]string) Option {
+	return func(o *Options) {
+		if o.Config == nil {
+			o.Config = make(map[string]string)
+		}
+		for k, v := range config {
+			o.Config[k] = v
+		}
+	}
+}
+
+// WithBinDir sets Options.BinDir.
+func WithBinDir(dir string) Option {
+	return func(o *Options) { o.BinDir = dir }
+}
@@ -0,0 +1,39 @@
+package pgtest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewOptions(t *testing.T) {
+	got := newOptions([]Option{
+		WithDBName("app"),
+		WithTCP(0),
+		WithConfig(map[string]string{"work_mem": "64MB", "jit": "on"}),
+		WithConfig(map[string]string{"jit": "off"}),
+		func(o *Options) { o.Durable = true },
+	})
+	want := Options{
+		DBName:    "app",
+		ListenTCP: true,
+		Config:    map[string]string{"work_mem": "64MB", "jit": "off"},
+		Durable:   true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("options = %+v, want %+v", got, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	pg, err := New(WithDBName("app"), WithSchema("CREATE TABLE t (n int)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pg.Stop()
+
+	var n int
+	err = pg.QueryRow("SELECT count(*) FROM t").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
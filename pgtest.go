@@ -1,5 +1,4 @@
 /*
-
 Package pgtest starts and stops a postgres server, quickly
 and conveniently, for Go unit tests. To use it:
 
@@ -10,18 +9,32 @@ and conveniently, for Go unit tests. To use it:
 		// etc.
 	}
 
-This package is not very configurable, though it may become
-so in the future.
+Code that has no *testing.T or *testing.B in scope, such as TestMain,
+examples, or a standalone program, can use StartErr and
+StopErr instead.
 
+Start uses reasonable defaults for a throwaway test server.
+To change them, such as to load a schema, set server
+settings, or create roles, pass an Options to StartWith.
 */
 package pgtest
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"text/template"
@@ -29,8 +42,14 @@ import (
 )
 
 var conf = template.Must(template.New("t").Parse(`
+{{if not .Durable}}
 fsync = off
-listen_addresses = ''
+full_page_writes = off
+{{end}}
+listen_addresses = '{{.ListenAddr}}'
+{{if .Port}}
+port = {{.Port}}
+{{end}}
 
 {{if .Plural}}
 unix_socket_directories = '{{.ConfDir}}'
@@ -38,112 +57,1729 @@ unix_socket_directories = '{{.ConfDir}}'
 unix_socket_directory = '{{.ConfDir}}'
 {{end}}
 
+{{if .Preload}}
+shared_preload_libraries = {{.Preload}}
+{{end}}
+{{if .Logical}}
+wal_level = logical
+max_replication_slots = 10
+max_wal_senders = 10
+{{end}}
+{{if .WALLevel}}
+wal_level = {{.WALLevel}}
+{{end}}
+{{if .ArchiveCommand}}
+archive_mode = on
+archive_command = {{.ArchiveCommand}}
+{{end}}
+{{if .MaxConnections}}
+max_connections = {{.MaxConnections}}
+{{end}}
+{{if .Timezone}}
+timezone = {{.Timezone}}
+{{end}}
+{{if .StatementTimeout}}
+statement_timeout = {{.StatementTimeout}}
+{{end}}
+{{if .LockTimeout}}
+lock_timeout = {{.LockTimeout}}
+{{end}}
+{{if .Isolation}}
+default_transaction_isolation = {{.Isolation}}
+{{end}}
+{{if .DisableJIT}}
+jit = off
+{{end}}
+{{if .DisableAutovacuum}}
+autovacuum = off
+{{end}}
+{{if ge .SlowQuery 0}}
+log_min_duration_statement = {{.SlowQuery}}
+{{end}}
+
+{{if .LogCollector}}
+logging_collector = on
+log_directory = '{{.LogDir}}'
+log_filename = '{{.LogName}}'
+{{end}}
+
+{{range .Config}}
+{{.Name}} = {{.Value}}
+{{end}}
 `))
 
-var pgtestdata = filepath.Join(os.TempDir(), "pgtestdata1")
+// confData is the input to conf.
+type confData struct {
+	ConfDir    string
+	Plural     bool
+	ListenAddr string
+	Durable    bool
+	Port       int
+	Preload    string        // quoted
+	Config     []confSetting // in order, after the defaults
+
+	Timezone       string // quoted
+	MaxConnections int
+	Logical        bool
+	WALLevel       string // quoted
+	ArchiveCommand string // quoted
+
+	LogCollector bool
+	LogDir       string // relative to the data directory
+	LogName      string
+
+	// In milliseconds; 0 means no limit.
+	StatementTimeout int64
+	LockTimeout      int64
+
+	SlowQuery int64 // in milliseconds; -1 means off
+
+	DisableJIT        bool
+	DisableAutovacuum bool
+
+	Isolation string // quoted
+}
+
+type confSetting struct {
+	Name  string
+	Value string // quoted
+}
+
+// confSettings returns the entries of m sorted by name,
+// with their values quoted for postgresql.conf.
+func confSettings(m map[string]string) []confSetting {
+	var a []confSetting
+	for k, v := range m {
+		a = append(a, confSetting{k, confQuote(v)})
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Name < a[j].Name })
+	return a
+}
+
+// writePostgresConf writes conf, from Options.PostgresConf,
+// to path, first checking that it leaves pgtest's settings alone.
+func writePostgresConf(path, conf string) error {
+	for _, line := range strings.Split(conf, "\n") {
+		switch name := confName(line); name {
+		case "listen_addresses", "port", "unix_socket_directories", "unix_socket_directory":
+			return fmt.Errorf("PostgresConf must not set %s", name)
+		}
+	}
+	return ioutil.WriteFile(path, []byte(conf), 0600)
+}
+
+// appendConf appends conf to the postgresql.conf file
+// at path, commenting out earlier lines for the settings
+// it changes, so each setting appears only once.
+func appendConf(path string, conf []byte) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(b)+string(conf), "\n")
+	last := make(map[string]int)
+	for i, line := range lines {
+		if name := confName(line); name != "" {
+			last[name] = i
+		}
+	}
+	for i, line := range lines {
+		if name := confName(line); name != "" && last[name] != i {
+			lines[i] = "#" + line
+		}
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0600)
+}
+
+// confName returns the lower-case name of the setting
+// in postgresql.conf line, or "" if there is none.
+// Include directives don't count; they may repeat.
+func confName(line string) string {
+	line = strings.TrimSpace(line)
+	i := strings.IndexAny(line, " \t=")
+	if i <= 0 || line[0] == '#' {
+		return ""
+	}
+	name := strings.ToLower(line[:i])
+	if strings.HasPrefix(name, "include") {
+		return ""
+	}
+	return name
+}
+
+// confQuote quotes s as a postgresql.conf string value.
+func confQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "'", "''", -1)
+	return "'" + s + "'"
+}
 
+// Errors returned by StartErr and the like, wrapping the
+// underlying cause, for use with errors.Is.
 var (
-	postgres string
-	initdbOk = false
-	once     sync.Once
+	ErrPostgresNotFound = errors.New("PostgreSQL not found")
+	ErrInitdbFailed     = errors.New("initdb failed")
+	ErrStartTimeout     = errors.New("timeout waiting for postgres to start")
 )
 
 type PG struct {
-	URL string // Connection URL for sql.Open.
-	t   *testing.T
-	dir string
-	cmd *exec.Cmd
+	// URL is a connection string for sql.Open, in the
+	// keyword=value form understood by both lib/pq and pgx.
+	URL string
+
+	t      testing.TB   // nil if started by StartErr
+	driver string       // for sql.Open; see Options.Driver
+	mode   ShutdownMode // for Stop
+	keep   bool         // Options.KeepOnFailure
+
+	persist bool // dir is Options.DataDir, not to be removed
+
+	inst *install
+	dir  string
+	cmd  *exec.Cmd
+	log  *logBuffer // postgres stdout and stderr
+	out  io.Writer  // log, plus Options.LogWriter
+	tlog *testLogWriter
+
+	logFile    string // if Options.LogCollector is set
+	archiveDir string // if Options.Archive is set
+
+	// exited is closed when cmd exits, after
+	// setting exitErr to the result of cmd.Wait.
+	exited  chan struct{}
+	exitErr error
+
+	// For launching the server again.
+	ctx     context.Context
+	timeout time.Duration
+	probe   func(*PG) error
+
+	snapshots []Snapshot // to remove in Stop
+
+	pool *Pool // to refill when stopped, if from Pool.Get
+
+	timings Timings
+
+	sockDir  string // holds the unix socket
+	host     string // socket directory or TCP address
+	port     int    // 0 means the default
+	user     string // the superuser
+	password string // of the superuser, if any
+
+	portChosen bool // port came from freePort
+
+	roles map[string]string // Options.Roles passwords, by name
+
+	maxConns int // Options.MaxConnections
+
+	mu      sync.Mutex
+	db      *sql.DB  // returned by DB
+	created []string // by CreateDB
+	killers []func() // stop StartConnectionKiller goroutines
+
+	tmplMu    sync.Mutex
+	templates map[string]bool // template databases made so far
+
+	dbname  string // the database at URL
+	appName string // Options.AppName
+
+	stopped bool // Stop has been called
+
+	// For a database on the shared server,
+	// server is that server and dir and cmd are unset.
+	server *PG
+}
+
+// Options holds optional settings for StartWith.
+// The zero value gives the same behavior as Start.
+type Options struct {
+	// DBName is the name of a database to create
+	// once the server is running. If it is empty,
+	// URL refers to the default database, postgres.
+	DBName string
+
+	// Encoding and Locale, if set, are passed to initdb
+	// as --encoding and --locale. Each distinct combination
+	// gets its own cached initdb output.
+	Encoding string
+	Locale   string
+
+	// InitdbArgs holds more flags for initdb, such as
+	// --wal-segsize=1. Like Encoding and Locale, each
+	// distinct set gets its own cached initdb output,
+	// so changing them means a fresh initdb.
+	InitdbArgs []string
+
+	// DataChecksums makes initdb enable data page
+	// checksums, so postgres detects corruption on disk.
+	// Like InitdbArgs, it gets its own cached initdb
+	// output. See VerifyChecksums.
+	DataChecksums bool
+
+	// BinDir is the directory holding the postgres and
+	// initdb binaries to use. If it is empty, pgtest uses
+	// $PGTEST_BINDIR, or failing that, asks pg_config.
+	BinDir string
+
+	// CacheDir is where to keep initdb output between
+	// runs. If it is empty, pgtest uses $PGTEST_CACHE,
+	// or failing that, a directory for the current user
+	// in TempDir.
+	CacheDir string
+
+	// DataDir, if set, is a data directory to keep
+	// between runs, rather than a temporary one, so
+	// the database's contents persist, for instance
+	// while debugging. If it holds no cluster that
+	// pgtest finished setting up, pgtest empties it and
+	// fills it as usual, setting up the database;
+	// otherwise, it starts the cluster there as is.
+	// Stop leaves it in place. Only one server at a
+	// time can use a given directory.
+	DataDir string
+
+	// TempDir is where to make data directories, and
+	// by default the initdb cache, for systems whose
+	// usual temporary directory is small or mounted
+	// noexec. If it is empty, pgtest uses $PGTEST_TMPDIR,
+	// or failing that, os.TempDir. CleanupStale looks for
+	// leftovers only in the latter two.
+	TempDir string
+
+	// Superuser is the name of the superuser, passed
+	// to initdb as --username, and used in URL.
+	// If it is empty, the name is postgres.
+	Superuser string
+
+	// Password, if set, is given to initdb as the
+	// superuser's password, and included in URL.
+	// Use it with AuthMethod or HBAConf to test
+	// password auth.
+	Password string
+
+	// AuthMethod, if set, is the authentication method
+	// in the pg_hba.conf that initdb writes, for local
+	// and host connections alike, such as "scram-sha-256"
+	// or "md5", rather than trust. Those that check a
+	// password need Password to be set too.
+	AuthMethod string
+
+	// HBAConf, if set, replaces the contents of
+	// pg_hba.conf, which by default lets any local
+	// user connect without a password.
+	HBAConf string
+
+	// Extensions lists extensions, such as pg_trgm,
+	// to create in the database before loading the schema.
+	Extensions []string
+
+	// SchemaFile names a file of SQL statements,
+	// separated by semicolons, to run in the database
+	// once the server is running.
+	SchemaFile string
+
+	// SchemaSQL holds SQL statements to run
+	// after those in SchemaFile.
+	SchemaSQL string
+
+	// MigrationsDir names a directory of migration files,
+	// in the style of golang-migrate. Each file named
+	// *.up.sql is run, in lexical order, after the schema.
+	MigrationsDir string
+
+	// PreloadLibraries lists libraries for the server
+	// to load at startup, via shared_preload_libraries,
+	// such as "pg_stat_statements". Extensions that need
+	// this still have to be listed in Extensions too.
+	PreloadLibraries []string
+
+	// Roles lists roles to create once the database
+	// is set up, so tests can connect as a user with
+	// limited privileges, using URLAs. Roles belong to
+	// the server as a whole, so StartSharedWith
+	// ignores this.
+	Roles []RoleSpec
+
+	// OnReady, if set, is called once the database
+	// is set up, after the schema and roles, for any
+	// other setup the test needs. The handle is limited
+	// to one connection, and closed when OnReady returns.
+	// If it returns an error, starting the server fails.
+	// Like the rest of the setup, it is skipped for
+	// an existing DataDir. With CacheSchema, it is not
+	// part of the cached copy, and runs on every server
+	// started from it.
+	OnReady func(db *sql.DB) error
+
+	// DBOwner names a role, usually one in Roles,
+	// to own the database at URL, rather than the
+	// superuser. The schema is still loaded as the
+	// superuser, so its objects keep that owner.
+	// Use URLAs(DBOwner) to connect as the owner.
+	DBOwner string
+
+	// AutoAnalyze makes StartWith run Analyze once
+	// the database is set up, after OnReady, so that
+	// plans are the same from one run to the next.
+	AutoAnalyze bool
+
+	// DumpFile names a pg_dump archive to restore into
+	// the database after the schema and migrations.
+	// Custom and directory format archives are restored
+	// with pg_restore, and plain SQL ones with psql,
+	// both from the same installation as postgres.
+	DumpFile string
+
+	// Logical sets wal_level to logical, with room for
+	// 10 replication slots and WAL senders, for testing
+	// logical decoding. Create a slot with, for instance,
+	//
+	//	SELECT pg_create_logical_replication_slot('test', 'test_decoding')
+	//
+	// and read changes with pg_logical_slot_get_changes.
+	Logical bool
+
+	// WALLevel, if set, is the server's wal_level,
+	// such as "replica" or "minimal". It overrides
+	// Logical.
+	WALLevel string
+
+	// Archive turns on WAL archiving, with an
+	// archive_command that copies each segment to
+	// a temporary directory, named by ArchiveDir,
+	// for testing backup and point-in-time recovery.
+	// Stop removes the directory.
+	Archive bool
+
+	// MaxConnections, if set, is the server's
+	// max_connections, for tests that open many
+	// connections at once. By default, initdb picks
+	// it, usually 100.
+	MaxConnections int
+
+	// Timezone, if set, is the server's time zone,
+	// such as "UTC", so that tests of time zone
+	// conversions give the same results everywhere.
+	// By default, postgres uses the host's time zone,
+	// as initdb found it.
+	Timezone string
+
+	// StatementTimeout and LockTimeout, if set, make
+	// the server abort any statement that runs, or waits
+	// for a lock, longer than that, with an error naming
+	// the statement. This turns a deadlocked test into a
+	// prompt failure, rather than a hang until go test
+	// times out; 30 seconds is a reasonable choice.
+	// Zero means no limit.
+	StatementTimeout time.Duration
+	LockTimeout      time.Duration
+
+	// SlowQueryThreshold, if set, makes the server log
+	// each statement that takes at least that long,
+	// along with its duration, via
+	// log_min_duration_statement. The lines go wherever
+	// the rest of the log goes; SlowQueries returns them.
+	SlowQueryThreshold time.Duration
+
+	// DisableJIT turns off JIT compilation of queries,
+	// which can make their timing unpredictable, and
+	// has crashed some builds. It needs postgres 11
+	// or later.
+	DisableJIT bool
+
+	// IsolationLevel, if set, is the default isolation
+	// level of transactions, via default_transaction_isolation,
+	// such as "serializable" or "repeatable read", so tests
+	// can provoke serialization failures without setting it
+	// on each connection.
+	IsolationLevel string
+
+	// DisableAutovacuum turns off autovacuum, so it
+	// can't take locks or change statistics in the
+	// middle of a test. Use Analyze to gather them.
+	DisableAutovacuum bool
+
+	// Durable keeps postgres's usual durability settings,
+	// rather than turning off fsync and full_page_writes
+	// for speed, for tests of crash recovery and the like.
+	Durable bool
+
+	// UseTmpfs puts the data directory on a memory-backed
+	// file system, /dev/shm, on Linux, which can make
+	// startup and writes much faster. Its contents are
+	// lost if the machine crashes, which is fine for
+	// tests. If there is no such file system, or it is
+	// short of space, the usual temporary directory
+	// is used instead.
+	UseTmpfs bool
+
+	// CacheSchema keeps a copy of the data directory
+	// once the database is set up, with its extensions,
+	// schema, migrations, and DumpFile, alongside the
+	// cached initdb output, and starts later servers
+	// from that copy. This skips setting up the schema
+	// in later runs of the tests, as well as later
+	// servers in this one. The copy is keyed by a hash
+	// of those options and the files they name, so
+	// changing them means a fresh copy.
+	CacheSchema bool
+
+	// StartTimeout is how long to wait for the server
+	// to accept connections. If it is zero, the
+	// timeout is one second.
+	StartTimeout time.Duration
+
+	// ReadyProbe, if set, decides when the server is
+	// ready, instead of the default of running SELECT 1
+	// in the postgres database. It is called repeatedly,
+	// until it returns nil or StartTimeout passes, and
+	// again after Restart and by WaitReady. During Start,
+	// URL names the postgres database; the probe should
+	// open its own connection with it, not use DB.
+	ReadyProbe func(pg *PG) error
+
+	// StartRetries is how many more times StartWith tries
+	// to start the server, logging each failure, if the
+	// first attempt fails, for instance by timing out on
+	// a slow CI machine. Attempts are spaced out, starting
+	// at 100ms and doubling each time.
+	StartRetries int
+
+	// Template holds SQL statements for a schema to copy
+	// into the database. The first time a server sees a
+	// given schema, it runs the statements in a template
+	// database; after that, databases with the same
+	// schema are made by cloning the template, which is
+	// much faster than running the statements again.
+	// This is most useful with StartSharedWith, where
+	// one server makes many databases.
+	// If DBName is empty, the database is named pgtest.
+	Template string
+
+	// ListenTCP makes the server listen on 127.0.0.1,
+	// in addition to its unix socket, and URL refer to
+	// that address instead of the socket.
+	// On Windows, the server always listens on TCP,
+	// and has no unix socket.
+	ListenTCP bool
+
+	// Port is the port to listen on. It also names
+	// the unix socket. If it is zero and ListenTCP is
+	// set, a free port is chosen; otherwise postgres
+	// uses its default, 5432. A port setting in Config
+	// overrides it.
+	Port int
+
+	// AppName is the application_name in URL, so that
+	// the server's logs and pg_stat_activity show where
+	// each connection came from. StartWith and
+	// StartSharedWith use the test's name by default.
+	AppName string
+
+	// Driver is the database/sql driver name pgtest uses
+	// to check that the server is ready and to open DB.
+	// If it is empty, the driver is "postgres", from
+	// github.com/lib/pq, which the program must import.
+	// pgtest itself imports neither driver. To use pgx,
+	// import github.com/jackc/pgx/v5/stdlib and set
+	// Driver to "pgx".
+	Driver string
+
+	// ShutdownMode is how Stop shuts down the server.
+	ShutdownMode ShutdownMode
+
+	// KeepOnFailure makes Stop, if the test has failed,
+	// shut down the server but leave its data directory
+	// in place for inspection, logging its location.
+	// CleanupStale leaves such directories alone;
+	// remove them by hand when done.
+	KeepOnFailure bool
+
+	// LogWriter, if set, receives the server's output
+	// as it is written.
+	LogWriter io.Writer
+
+	// LogCollector makes the server write its log to
+	// a file in its data directory, named by LogFile,
+	// rather than to its standard error, so the logs of
+	// servers running in parallel are kept apart. Once
+	// the collector starts, Log, LogWriter, and Verbose
+	// see only what it writes at startup.
+	LogCollector bool
+
+	// Verbose makes StartWith pass the server's output
+	// to t.Log, line by line, as it is written. Set
+	// log_statement to all in Config to see every
+	// statement the test runs.
+	Verbose bool
+
+	// PostgresConf, if set, replaces the postgresql.conf
+	// that initdb wrote, along with pgtest's own settings
+	// for speed, such as fsync = off. Settings that other
+	// options call for are still appended, as are the
+	// ones pgtest needs to reach the server, so it must
+	// not set listen_addresses, port, or the socket
+	// directory; use ListenTCP and Port instead.
+	PostgresConf string
+
+	// Config holds extra postgresql.conf settings,
+	// such as {"shared_buffers": "256MB"}. They take
+	// precedence over pgtest's own settings, like
+	// fsync = off.
+	Config map[string]string
+}
+
+// A ShutdownMode is one of postgres's shutdown modes.
+// See https://www.postgresql.org/docs/current/server-shutdown.html.
+type ShutdownMode int
+
+const (
+	// ShutdownFast aborts open transactions and
+	// disconnects clients, then shuts down cleanly.
+	ShutdownFast ShutdownMode = iota
+
+	// ShutdownSmart waits for clients to disconnect.
+	ShutdownSmart
+
+	// ShutdownImmediate exits without a clean shutdown.
+	// It is the quickest, and since Stop discards
+	// the data directory, it loses nothing.
+	ShutdownImmediate
+)
+
+// SkipIfUnavailable skips the test if PostgreSQL
+// is not installed, as found by Start, so suites can pass
+// on machines without it. Call it before Start:
+//
+//	pgtest.SkipIfUnavailable(t)
+//	pg := pgtest.Start(t)
+//
+// Start itself still fails the test in that case.
+func SkipIfUnavailable(t testing.TB) {
+	_, err := findInstall(Options{})
+	if errors.Is(err, ErrPostgresNotFound) {
+		t.Skip("pgtest:", err)
+	}
 }
 
 // Start runs postgres in a temporary directory,
 // with a default file set produced by initdb.
 // If an error occurs, the test will fail.
-func Start(t *testing.T) *PG {
-	once.Do(func() { maybeInitdb(t) })
-	if !initdbOk {
-		t.Fatal("prior initdb attempt failed")
+// Start takes a testing.TB, so it works in
+// benchmarks as well as tests.
+func Start(t testing.TB) *PG {
+	return StartWith(t, Options{})
+}
+
+// StartCleanup is like Start, but registers pg.Stop
+// with t.Cleanup, so there is no need to defer it.
+// The server then outlives any subtests, and is
+// stopped even if the test fails early.
+// Calling Stop sooner is harmless.
+func StartCleanup(t testing.TB) *PG {
+	pg := Start(t)
+	t.Cleanup(pg.Stop)
+	return pg
+}
+
+// StartWith is like Start, but with the settings in opts.
+func StartWith(t testing.TB, opts Options) *PG {
+	if opts.AppName == "" {
+		opts.AppName = t.Name()
+	}
+	var tlog *testLogWriter
+	if opts.Verbose {
+		tlog = &testLogWriter{t: t}
+		if opts.LogWriter != nil {
+			opts.LogWriter = io.MultiWriter(tlog, opts.LogWriter)
+		} else {
+			opts.LogWriter = tlog
+		}
+	}
+	pg, err := startRetry(context.Background(), "", opts, t.Logf)
+	if err != nil {
+		t.Fatal(err)
 	}
-	var err error
-	pg := new(PG)
 	pg.t = t
-	pg.dir, err = ioutil.TempDir("", "pgtest")
+	pg.tlog = tlog
+	return pg
+}
+
+// maxBackoff caps the wait between start attempts.
+const maxBackoff = 5 * time.Second
+
+// startRetry calls start up to 1+opts.StartRetries times,
+// until it succeeds, logging each failure with logf.
+// A negative StartRetries counts as zero.
+func startRetry(ctx context.Context, dir string, opts Options, logf func(string, ...interface{})) (*PG, error) {
+	backoff := 100 * time.Millisecond
+	for i := 0; ; i++ {
+		pg, err := start(ctx, dir, opts)
+		if err == nil || i >= opts.StartRetries || errors.Is(err, ErrPostgresNotFound) {
+			return pg, err
+		}
+		logf("pgtest: start failed, retrying in %v (%d of %d): %v", backoff, i+1, opts.StartRetries, err)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// StartN starts n independent servers, as Start does,
+// in parallel. Stop them individually or with StopN.
+// If an error occurs, the test will fail.
+func StartN(t testing.TB, n int) []*PG {
+	pgs := make([]*PG, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range pgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pgs[i], errs[i] = start(context.Background(), "", Options{AppName: t.Name()})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			for _, pg := range pgs {
+				if pg != nil {
+					pg.StopErr()
+				}
+			}
+			t.Fatal(err)
+		}
+	}
+	for _, pg := range pgs {
+		pg.t = t
+	}
+	return pgs
+}
+
+// StopN stops each of pgs.
+func StopN(pgs []*PG) {
+	for _, pg := range pgs {
+		pg.Stop()
+	}
+}
+
+// StartContext is like Start, but if ctx is done
+// before the server is ready, it stops waiting and
+// fails with the context's error. The server process
+// is killed whenever ctx is done.
+func StartContext(ctx context.Context, t testing.TB) *PG {
+	pg, err := start(ctx, "", Options{AppName: t.Name()})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = exec.Command("cp", "-a", pgtestdata+"/.", pg.dir).Run()
+	pg.t = t
+	return pg
+}
+
+// StartErr is like Start, but returns an error
+// instead of failing a test.
+// The temporary data directory is created in dir;
+// if dir is empty, $PGTEST_TMPDIR is used, or failing
+// that, the default directory for temporary files
+// (see os.TempDir).
+func StartErr(dir string) (*PG, error) {
+	return start(context.Background(), dir, Options{})
+}
+
+func start(ctx context.Context, dir string, opts Options) (*PG, error) {
+	t0 := time.Now()
+	inst, data, err := initCache(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.CacheSchema {
+		data, err = schemaCache(ctx, data, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pg := new(PG)
+	pg.timings.Init = time.Since(t0)
+	pg.inst = inst
+	pg.driver = opts.Driver
+	pg.appName = opts.AppName
+	pg.mode = opts.ShutdownMode
+	pg.keep = opts.KeepOnFailure
+	if opts.DataDir != "" {
+		pg.dir = opts.DataDir
+		pg.persist = true
+		err = os.MkdirAll(pg.dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if dir == "" && opts.UseTmpfs {
+			dir = tmpfsDir()
+		}
+		if dir == "" {
+			dir = tempBase(opts)
+		}
+		pg.dir, err = ioutil.TempDir(dir, "pgtest")
+		if err != nil {
+			return nil, err
+		}
+		err = writeOwner(pg.dir)
+		if err != nil {
+			os.RemoveAll(pg.dir)
+			return nil, err
+		}
+	}
+	err = pg.start(ctx, opts, data)
 	if err != nil {
-		t.Fatal("copy:", err)
+		if pg.exited != nil {
+			pg.cmd.Process.Kill()
+			<-pg.exited
+		}
+		if pg.log != nil {
+			err = fmt.Errorf("%w\npostgres output:\n%s", err, pg.log.tail(20))
+		}
+		pg.releasePort()
+		pg.removeAll()
+		return nil, err
 	}
+	pg.URL = pg.withAppName(pg.URL)
+	pg.timings.Total = time.Since(t0)
+	return pg, nil
+}
+
+// start copies the initdb output in data
+// to pg.dir and runs postgres there. If pg.dir
+// is an existing Options.DataDir, it starts
+// postgres there as is.
+func (pg *PG) start(ctx context.Context, opts Options, data string) error {
+	t0 := time.Now()
+	_, err := os.Stat(filepath.Join(pg.dir, readyFile))
+	existing := pg.persist && err == nil
+	if pg.persist && !existing {
+		// Whatever is there is left from a run
+		// that failed before it was set up.
+		err = emptyDir(pg.dir)
+		if err != nil {
+			return err
+		}
+	}
+	if existing {
+		// Start from initdb's configuration,
+		// rather than what the last run appended.
+		path := filepath.Join(pg.dir, "postgresql.conf")
+		err = os.Remove(path)
+		if err == nil {
+			err = copyFile(filepath.Join(data, "postgresql.conf"), path, 0600)
+		}
+	} else {
+		var size uint64
+		size, err = dirSize(data)
+		if err == nil {
+			err = checkSpace(pg.dir, size)
+		}
+		if err == nil {
+			err = copyDir(data, pg.dir)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+	pg.timings.Copy = time.Since(t0)
+	if opts.HBAConf != "" {
+		err = ioutil.WriteFile(filepath.Join(pg.dir, "pg_hba.conf"), []byte(opts.HBAConf), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	pg.user = superuser(opts)
+	pg.password = opts.Password
+	pg.maxConns = opts.MaxConnections
 	path := filepath.Join(pg.dir, "postgresql.conf")
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	pg.sockDir, err = makeSockDir()
 	if err != nil {
-		t.Fatal(err)
+		return err
+	}
+	pg.host = pg.sockDir
+	pg.port = opts.Port
+	if v, ok := opts.Config["port"]; ok {
+		// Config is written last, so it wins.
+		pg.port, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("bad port in Config: %w", err)
+		}
+	}
+	var listen string
+	autoPort := false
+	if opts.ListenTCP || forceTCP {
+		pg.host = "127.0.0.1"
+		listen = pg.host
+		if pg.port == 0 {
+			autoPort = true
+			pg.port, err = freePort()
+			if err != nil {
+				return err
+			}
+			pg.portChosen = true
+		}
+	}
+	var preload string
+	if len(opts.PreloadLibraries) > 0 {
+		err = checkLibraries(pg.inst, opts.PreloadLibraries)
+		if err != nil {
+			return err
+		}
+		preload = confQuote(strings.Join(opts.PreloadLibraries, ","))
+	}
+	var walLevel, archive string
+	if opts.WALLevel != "" {
+		walLevel = confQuote(opts.WALLevel)
+	}
+	if opts.Archive {
+		pg.archiveDir, err = ioutil.TempDir(filepath.Dir(pg.dir), archivePrefix)
+		if err != nil {
+			return err
+		}
+		err = writeOwner(pg.archiveDir)
+		if err != nil {
+			return err
+		}
+		archive = confQuote(archiveCommand(pg.archiveDir))
+	}
+	var timezone string
+	if opts.Timezone != "" {
+		timezone = confQuote(opts.Timezone)
+	}
+	if opts.LogCollector {
+		pg.logFile = filepath.Join(pg.dir, logDir, logName)
+	}
+	var isolation string
+	if opts.IsolationLevel != "" {
+		level := strings.ToLower(opts.IsolationLevel)
+		if !isolationLevels[level] {
+			return fmt.Errorf("unknown isolation level %q", opts.IsolationLevel)
+		}
+		isolation = confQuote(level)
+	}
+	slowQuery := int64(-1)
+	if opts.SlowQueryThreshold > 0 {
+		slowQuery = opts.SlowQueryThreshold.Milliseconds()
 	}
 	plural := !contains("unix_socket_directory", path)
-	err = conf.Execute(f, struct {
-		ConfDir string
-		Plural  bool
-	}{pg.dir, plural})
+	if opts.PostgresConf != "" {
+		err = writePostgresConf(path, opts.PostgresConf)
+		if err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	err = conf.Execute(&buf, confData{
+		ConfDir:    pg.sockDir,
+		Plural:     plural,
+		ListenAddr: listen,
+		Durable:    opts.Durable || opts.PostgresConf != "",
+		Port:       pg.port,
+		Preload:    preload,
+		Config:     confSettings(opts.Config),
+
+		Timezone:       timezone,
+		MaxConnections: opts.MaxConnections,
+		Logical:        opts.Logical,
+		WALLevel:       walLevel,
+		ArchiveCommand: archive,
+
+		LogCollector: opts.LogCollector,
+		LogDir:       logDir,
+		LogName:      logName,
+
+		StatementTimeout: opts.StatementTimeout.Milliseconds(),
+		LockTimeout:      opts.LockTimeout.Milliseconds(),
+
+		SlowQuery: slowQuery,
+
+		DisableJIT:        opts.DisableJIT,
+		DisableAutovacuum: opts.DisableAutovacuum,
+
+		Isolation: isolation,
+	})
 	if err != nil {
-		t.Fatal(err)
+		return err
 	}
-	err = f.Close()
+	err = appendConf(path, buf.Bytes())
 	if err != nil {
-		t.Fatal(err)
+		return err
+	}
+	pg.dbname = "postgres"
+	pg.URL = pg.dsn(pg.dbname)
+	pg.log = new(logBuffer)
+	pg.out = pg.log
+	if opts.LogWriter != nil {
+		pg.out = io.MultiWriter(pg.log, opts.LogWriter)
+	}
+	pg.ctx = ctx
+	pg.timeout = opts.StartTimeout
+	pg.probe = opts.ReadyProbe
+	if pg.timeout == 0 {
+		pg.timeout = time.Second
+	}
+	t1 := time.Now()
+	err = pg.launch()
+	for i := 0; err != nil && autoPort && i < portRetries && pg.portInUse(); i++ {
+		// Something else took the port between
+		// freePort and postgres binding it.
+		releasePort(pg.port)
+		pg.portChosen = false
+		pg.port, err = freePort()
+		if err != nil {
+			return err
+		}
+		pg.portChosen = true
+		err = appendConf(path, []byte("port = "+strconv.Itoa(pg.port)+"\n"))
+		if err != nil {
+			return err
+		}
+		pg.URL = pg.dsn(pg.dbname)
+		err = pg.launch()
+	}
+	if err != nil {
+		return err
+	}
+	pg.timings.Launch = time.Since(t1)
+	t2 := time.Now()
+	defer func() { pg.timings.Setup = time.Since(t2) }()
+	name := opts.DBName
+	if name == "" && opts.Template != "" {
+		name = "pgtest" // can't clone into postgres; it exists
+	}
+	if existing {
+		// Everything is set up from the last run.
+		if name != "" {
+			pg.dbname = name
+			pg.URL = pg.dsn(name)
+		}
+		pg.addRoles(opts.Roles)
+		return nil
 	}
-	pg.URL = "host=" + pg.dir + " dbname=postgres sslmode=disable"
-	pg.cmd = exec.Command(postgres, "-D", pg.dir)
+	if opts.CacheSchema {
+		// The cached data directory has the database already.
+		if name != "" {
+			pg.dbname = name
+			pg.URL = pg.dsn(name)
+		}
+	} else {
+		if name != "" {
+			err = pg.createDB(name, opts.Template)
+			if err != nil {
+				return err
+			}
+			pg.dbname = name
+			pg.URL = pg.dsn(name)
+		}
+		err = pg.setupDB(opts)
+		if err != nil {
+			return err
+		}
+	}
+	err = pg.createRoles(opts.Roles)
+	if err != nil {
+		return err
+	}
+	if opts.DBOwner != "" {
+		err = pg.setOwner(opts.DBOwner)
+		if err != nil {
+			return err
+		}
+	}
+	err = pg.onReady(opts.OnReady)
+	if err != nil {
+		return err
+	}
+	if opts.AutoAnalyze {
+		err = pg.Analyze()
+		if err != nil {
+			return fmt.Errorf("analyze: %w", err)
+		}
+	}
+	if pg.persist {
+		return ioutil.WriteFile(filepath.Join(pg.dir, readyFile), nil, 0666)
+	}
+	return nil
+}
+
+// readyFile marks an Options.DataDir as set up,
+// so later runs can start it as is.
+const readyFile = "pgtest.ready"
+
+// emptyDir removes everything in dir.
+func emptyDir(dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = os.RemoveAll(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// onReady calls f, if it is set, with a handle
+// to the database at URL.
+func (pg *PG) onReady(f func(*sql.DB) error) error {
+	if f == nil {
+		return nil
+	}
+	err := pg.withDB(pg.URL, f)
+	if err != nil {
+		return fmt.Errorf("OnReady: %w", err)
+	}
+	return nil
+}
+
+// WaitReady waits up to timeout for the server to accept
+// connections, as Start does, and returns an error if it
+// does not. It is useful after doing something that might
+// have restarted the server.
+func (pg *PG) WaitReady(timeout time.Duration) error {
+	return pg.srv().wait(context.Background(), timeout)
+}
+
+// launch runs postgres in pg.dir and waits
+// for it to accept connections.
+func (pg *PG) launch() error {
+	err := pg.removeSockets()
+	if err != nil {
+		return err
+	}
+	pg.cmd = exec.CommandContext(pg.ctx, pg.inst.postgres, "-D", pg.dir)
+	pg.cmd.Stdout = pg.out
+	pg.cmd.Stderr = pg.out
 	err = pg.cmd.Start()
 	if err != nil {
-		t.Fatal("starting postgres:", err)
+		return fmt.Errorf("starting postgres: %w", err)
+	}
+	exited := make(chan struct{})
+	pg.exited = exited
+	go func(cmd *exec.Cmd) {
+		pg.exitErr = cmd.Wait()
+		close(exited)
+	}(pg.cmd)
+	return pg.wait(pg.ctx, pg.timeout)
+}
+
+// wait waits for the server to accept connections,
+// by running a trivial query until it succeeds,
+// or by polling Options.ReadyProbe if it was set.
+// The socket file alone isn't enough; postgres creates
+// it before it is ready to serve queries.
+func (pg *PG) wait(ctx context.Context, timeout time.Duration) error {
+	if pg.probe != nil {
+		return pg.poll(ctx, timeout, func() error {
+			return pg.probe(pg)
+		})
+	}
+	return pg.withDB(pg.dsn("postgres"), func(db *sql.DB) error {
+		return pg.poll(ctx, timeout, func() error {
+			var n int
+			return db.QueryRowContext(ctx, "SELECT 1").Scan(&n)
+		})
+	})
+}
+
+// poll calls ready until it succeeds, timeout passes,
+// or the server exits.
+func (pg *PG) poll(ctx context.Context, timeout time.Duration, ready func() error) error {
+	var err error
+	deadline := time.Now().Add(timeout)
+	for {
+		err = ready()
+		if err == nil {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for postgres to start: %w", ctx.Err())
+		case <-pg.exited:
+			return fmt.Errorf("postgres exited unexpectedly: %v", pg.exitErr)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	if pg.host == pg.sockDir {
+		if _, err := os.Stat(pg.sockFile()); err != nil {
+			return fmt.Errorf("%w after %v: no socket %s", ErrStartTimeout, timeout, pg.sockFile())
+		}
+	}
+	return fmt.Errorf("%w after %v: %w", ErrStartTimeout, timeout, err)
+}
+
+// removeSockets removes any socket and lock files left
+// in sockDir, for instance by a server that was killed,
+// so they can't be mistaken for the new server's.
+func (pg *PG) removeSockets() error {
+	if pg.sockDir == "" {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(pg.sockDir, ".s.PGSQL.*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = os.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultPort is the port postgres uses if none is set.
+const defaultPort = 5432
+
+// sockFile returns the path of the unix socket
+// postgres creates in sockDir for pg.port.
+func (pg *PG) sockFile() string {
+	port := pg.port
+	if port == 0 {
+		port = defaultPort
+	}
+	return filepath.Join(pg.sockDir, ".s.PGSQL."+strconv.Itoa(port))
+}
+
+// Params returns the connection parameters of URL,
+// by their libpq keywords: host, port, user, password,
+// dbname, sslmode, and application_name. Those that
+// aren't set, such as port for the default, are absent.
+// A host starting with a slash is the socket directory.
+func (pg *PG) Params() map[string]string {
+	srv := pg.srv()
+	p := map[string]string{
+		"host":    srv.host,
+		"dbname":  pg.dbname,
+		"sslmode": "disable",
+	}
+	if srv.port != 0 {
+		p["port"] = strconv.Itoa(srv.port)
+	}
+	if srv.user != "" {
+		p["user"] = srv.user
+	}
+	if srv.password != "" {
+		p["password"] = srv.password
+	}
+	if pg.appName != "" {
+		p["application_name"] = pg.appName
+	}
+	return p
+}
+
+// DSN returns a postgres:// URL for the database at URL,
+// for tools that don't accept the keyword=value form.
+func (pg *PG) DSN() string {
+	p := pg.Params()
+	u := url.URL{Scheme: "postgres", Path: "/" + p["dbname"]}
+	q := url.Values{}
+	if user := p["user"]; user != "" {
+		u.User = url.User(user)
+	}
+	if host := p["host"]; strings.HasPrefix(host, "/") {
+		q.Set("host", host)
+		if port := p["port"]; port != "" {
+			q.Set("port", port)
+		}
+	} else {
+		u.Host = net.JoinHostPort(host, p["port"])
+	}
+	for k, v := range p {
+		switch k {
+		case "host", "port", "user", "dbname":
+		default:
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// dsn returns a connection string for database dbname.
+func (pg *PG) dsn(dbname string) string {
+	return pg.dsnAs(dbname, "", pg.password)
+}
+
+// dsnAs returns a connection string for database dbname,
+// authenticating as user, or the superuser if it is empty.
+func (pg *PG) dsnAs(dbname, user, password string) string {
+	if user == "" {
+		user = pg.user
+	}
+	s := "host=" + dsnQuote(pg.host)
+	if pg.port != 0 {
+		s += " port=" + strconv.Itoa(pg.port)
+	}
+	if user != "" {
+		s += " user=" + dsnQuote(user)
+	}
+	if password != "" {
+		s += " password=" + dsnQuote(password)
+	}
+	return s + " dbname=" + dsnQuote(dbname) + " sslmode=disable"
+}
+
+// withAppName adds pg's application_name to url,
+// if it has one.
+func (pg *PG) withAppName(url string) string {
+	if pg.appName == "" {
+		return url
+	}
+	return url + " application_name=" + dsnQuote(pg.appName)
+}
+
+// dsnQuote quotes s, if need be, as a value
+// in a keyword=value connection string.
+func dsnQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, ` '\`) {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `'`, `\'`, -1)
+	return "'" + s + "'"
+}
+
+// quoteIdent quotes s as an SQL identifier.
+func quoteIdent(s string) string {
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i] // postgres would stop there anyway
 	}
-	sock := filepath.Join(pg.dir, ".s.PGSQL.5432")
-	for n := 0; n < 20; n++ {
-		if _, err := os.Stat(sock); err == nil {
-			return pg
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// quoteLiteral quotes s as an SQL string literal,
+// using the E'...' form if it has backslashes, so it
+// means the same whatever standard_conforming_strings
+// is set to.
+func quoteLiteral(s string) string {
+	s = strings.Replace(s, `'`, `''`, -1)
+	if strings.Contains(s, `\`) {
+		return "E'" + strings.Replace(s, `\`, `\\`, -1) + `'`
+	}
+	return "'" + s + "'"
+}
+
+func (pg *PG) driverName() string {
+	if pg.driver == "" {
+		return "postgres"
+	}
+	return pg.driver
+}
+
+// portRetries is how many times start tries another port
+// if the one freePort chose is taken by the time postgres
+// tries to listen on it.
+const portRetries = 5
+
+var (
+	portMu sync.Mutex
+	ports  = make(map[int]bool) // returned by freePort
+)
+
+// portTries is how many ports freePort asks
+// the kernel for before giving up.
+const portTries = 100
+
+// freePort returns a TCP port on 127.0.0.1
+// that nothing is listening on, and that it
+// has not returned to a server that is still
+// running in this process. Something else might
+// take it before postgres does; see portInUse.
+func freePort() (int, error) {
+	portMu.Lock()
+	defer portMu.Unlock()
+	for i := 0; i < portTries; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if !ports[port] {
+			ports[port] = true
+			return port, nil
 		}
-		time.Sleep(50 * time.Millisecond)
 	}
-	t.Fatal("timeout waiting for postgres to start")
-	panic("unreached")
+	return 0, fmt.Errorf("no free port after %d tries", portTries)
+}
+
+// releasePort lets freePort return port again.
+func releasePort(port int) {
+	portMu.Lock()
+	defer portMu.Unlock()
+	delete(ports, port)
 }
 
+// releasePort releases pg's port, if freePort chose it,
+// once the server has stopped.
+func (pg *PG) releasePort() {
+	if pg.portChosen {
+		releasePort(pg.port)
+		pg.portChosen = false
+	}
+}
+
+// portInUse reports whether postgres's output
+// says it failed to listen because its port was taken.
+func (pg *PG) portInUse() bool {
+	s := pg.log.tail(10)
+	return strings.Contains(s, "already in use") ||
+		strings.Contains(s, "Only one usage of each socket address")
+}
+
+// exec runs query in database dbname
+// on a short-lived connection.
+func (pg *PG) exec(dbname, query string) error {
+	return pg.withDB(pg.dsn(dbname), func(db *sql.DB) error {
+		_, err := db.Exec(query)
+		return err
+	})
+}
+
+// withDB calls f with a short-lived handle
+// to the database at url, limited to a single
+// connection so that session state persists
+// from one statement to the next.
+func (pg *PG) withDB(url string, f func(*sql.DB) error) error {
+	db, err := sql.Open(pg.driverName(), url)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	return f(db)
+}
+
+// Dir returns the server's data directory.
+func (pg *PG) Dir() string {
+	if pg.server != nil {
+		return pg.server.Dir()
+	}
+	return pg.dir
+}
+
+// Log returns everything the server has written
+// to its standard output and standard error so far.
+func (pg *PG) Log() string {
+	if pg.server != nil {
+		return pg.server.Log()
+	}
+	return pg.log.String()
+}
+
+// Timings records how long the steps of starting
+// a server took.
+type Timings struct {
+	Init   time.Duration // finding postgres, and running initdb if need be
+	Copy   time.Duration // copying the initdb output
+	Launch time.Duration // running postgres until it accepts connections
+	Setup  time.Duration // creating and setting up the database
+	Total  time.Duration // from beginning to end
+}
+
+// StartDuration returns how long it took to start
+// the server and set up the database.
+func (pg *PG) StartDuration() time.Duration {
+	return pg.timings.Total
+}
+
+// Timings returns how long each step of starting the
+// server took, for measuring the effect of options such
+// as UseTmpfs and CacheSchema. For a PG returned by
+// StartShared, it is the zero value.
+func (pg *PG) Timings() Timings {
+	return pg.timings
+}
+
+// ArchiveDir returns the directory that WAL segments
+// are archived to, if Options.Archive was set, or else "".
+func (pg *PG) ArchiveDir() string {
+	return pg.srv().archiveDir
+}
+
+// LogFile returns the path of the server's log file,
+// if Options.LogCollector was set, or else "".
+func (pg *PG) LogFile() string {
+	return pg.srv().logFile
+}
+
+// Version returns the version of the running postgres
+// server, such as "15.4".
+func (pg *PG) Version() string {
+	return pg.srv().inst.version
+}
+
+// isolationLevels are the values
+// of default_transaction_isolation.
+var isolationLevels = map[string]bool{
+	"serializable":     true,
+	"repeatable read":  true,
+	"read committed":   true,
+	"read uncommitted": true,
+}
+
+// Where the server writes its log, if Options.LogCollector is set.
+const (
+	logDir  = "log" // in the data directory
+	logName = "postgresql.log"
+)
+
+// stopTimeout is how long Stop waits for postgres
+// to shut down before killing it.
+const stopTimeout = 10 * time.Second
+
 // Stop stops the running postgres process and removes its
 // temporary data directory.
+// For a PG returned by StartShared, Stop instead drops
+// its database, leaving the shared server running.
+// Calls after the first do nothing.
 // If an error occurs, the test will fail.
 func (pg *PG) Stop() {
-	err := pg.cmd.Process.Signal(os.Interrupt)
+	err := pg.StopErr()
 	if err != nil {
-		pg.t.Fatal("postgres:", err)
+		pg.fatal(err)
+	}
+}
+
+// fatal fails the test that started pg, or panics
+// if pg was not started by a test.
+func (pg *PG) fatal(args ...interface{}) {
+	if pg.t == nil {
+		panic(strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
 	}
-	err = os.RemoveAll(pg.dir)
+	pg.t.Fatal(args...)
+}
+
+// StopErr is like Stop, but returns an error
+// instead of failing a test.
+func (pg *PG) StopErr() error {
+	if pg.stopped {
+		return nil
+	}
+	pg.stopped = true
+	if pg.pool != nil {
+		defer pg.pool.fill()
+		pg.pool = nil
+	}
+	pg.stopKillers()
+	pg.closeDB()
+	if pg.server != nil {
+		// Databases on the shared server outlive us
+		// unless we drop them.
+		for _, name := range pg.created {
+			err := pg.server.dropDB(name)
+			if err != nil {
+				return err
+			}
+		}
+		pg.created = nil
+		return pg.server.dropDB(pg.dbname)
+	}
+	err := pg.halt(pg.mode)
 	if err != nil {
-		pg.t.Fatal(err)
+		return err
+	}
+	pg.releasePort()
+	if pg.tlog != nil {
+		// The server has exited, and cmd.Wait has
+		// copied the last of its output. Nothing
+		// more will be written.
+		pg.tlog.flush()
+	}
+	pg.removeSnapshots()
+	if pg.keep && pg.t != nil && pg.t.Failed() {
+		pg.t.Logf("pgtest: keeping data directory %s", pg.dir)
+		if pg.logFile != "" {
+			pg.t.Logf("pgtest: server log is in %s", pg.logFile)
+		}
+		pg.t.Logf("pgtest: restart it with: %s -D %s", pg.inst.postgres, pg.dir)
+		// Its config names the socket and archive
+		// directories, so keep them too.
+		for _, dir := range []string{pg.dir, pg.sockDir, pg.archiveDir} {
+			if dir == "" {
+				continue
+			}
+			err := ioutil.WriteFile(filepath.Join(dir, keepFile), nil, 0666)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	}
+	return pg.removeAll()
 }
 
-func maybeInitdb(t *testing.T) {
-	out, err := exec.Command("pg_config", "--bindir").Output()
+// halt shuts down the server in the given mode and
+// waits for it to exit, killing it if that takes
+// longer than stopTimeout.
+func (pg *PG) halt(mode ShutdownMode) error {
+	select {
+	case <-pg.exited:
+		return nil // already gone
+	default:
+	}
+	err := pg.shutdown(mode)
 	if err != nil {
-		t.Fatal("pg_config", err)
+		return fmt.Errorf("postgres: %w", err)
 	}
-	bindir := string(bytes.TrimSpace(out))
-	postgres = filepath.Join(bindir, "postgres")
-	initdb := filepath.Join(bindir, "initdb")
-	err = os.Mkdir(pgtestdata, 0777)
-	if os.IsExist(err) {
-		initdbOk = true
-		return
+	select {
+	case <-pg.exited:
+	case <-time.After(stopTimeout):
+		pg.cmd.Process.Kill()
+		<-pg.exited
 	}
+	return nil
+}
+
+// PID returns the process ID of the postmaster.
+func (pg *PG) PID() int {
+	return pg.srv().cmd.Process.Pid
+}
+
+// Kill kills the server abruptly, with SIGKILL on Unix,
+// to simulate a crash. Clients see their connections
+// drop, and can't reconnect. The data directory is left
+// in place for Stop to remove.
+func (pg *PG) Kill() error {
+	if pg.server != nil {
+		return errShared
+	}
+	select {
+	case <-pg.exited:
+		return nil // already gone
+	default:
+	}
+	err := pg.cmd.Process.Kill()
 	if err != nil {
-		t.Fatal(err)
+		return err
+	}
+	<-pg.exited
+	return nil
+}
+
+// Wait blocks until the server exits, and returns the
+// error, if any, from waiting for its process, so a program
+// using StartErr can run a server until it is interrupted.
+// Interrupting the program from a terminal interrupts the
+// server too, which shuts down, ending Wait; so does Stop
+// from another goroutine, say on a signal. Either way,
+// call Stop afterward to remove the data directory.
+// Restart, too, ends Wait.
+func (pg *PG) Wait() error {
+	if pg.server != nil {
+		return errShared
+	}
+	<-pg.exited
+	return pg.exitErr
+}
+
+// Restart shuts down the server, using the ShutdownMode
+// from Options, and starts it again on the same data
+// directory, with the same URL. Data is kept; existing
+// connections are closed, and clients must reconnect.
+// After Kill, Restart makes postgres recover from the crash.
+func (pg *PG) Restart() error {
+	if pg.server != nil {
+		return errShared
 	}
-	err = exec.Command(initdb, "-D", pgtestdata).Run()
+	err := pg.halt(pg.mode)
 	if err != nil {
-		os.RemoveAll(pgtestdata)
-		t.Fatal("initdb", err)
+		return err
+	}
+	return pg.launch()
+}
+
+// removeAll removes the data, socket, and archive directories.
+// An Options.DataDir is left alone.
+func (pg *PG) removeAll() error {
+	var err error
+	if !pg.persist {
+		err = os.RemoveAll(pg.dir)
+	}
+	if err1 := os.RemoveAll(pg.sockDir); err == nil {
+		err = err1
+	}
+	if pg.archiveDir != "" {
+		if err1 := os.RemoveAll(pg.archiveDir); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// logBuffer collects server output.
+// It is safe to read while postgres is writing to it.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// testLogWriter passes each line written to it to t.Log.
+type testLogWriter struct {
+	t   testing.TB
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *testLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.t.Log(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs any partial last line.
+func (w *testLogWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.t.Log(string(w.buf))
+		w.buf = nil
+	}
+}
+
+// tail returns the last n lines written to b.
+func (b *logBuffer) tail(n int) string {
+	lines := strings.Split(strings.TrimRight(b.String(), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
 	}
-	initdbOk = true
+	return strings.Join(lines, "\n")
 }
 
 func contains(substr, name string) bool {
@@ -1,9 +1,20 @@
 package pgtest
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	_ "github.com/lib/pq"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRun(t *testing.T) {
@@ -20,6 +31,1052 @@ func TestRun(t *testing.T) {
 		t.Fatal(err)
 	}
 	if n != 1 {
-		t.Fatal("SELECT 1 = %d", n)
+		t.Fatalf("SELECT 1 = %d", n)
+	}
+}
+
+func TestStartErr(t *testing.T) {
+	pg, err := StartErr("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	err = db.Ping()
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.StopErr()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBName(t *testing.T) {
+	pg := StartWith(t, Options{DBName: "myapp"})
+	defer pg.Stop()
+
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	defer db.Close()
+	var name string
+	err = db.QueryRow("SELECT current_database()").Scan(&name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "myapp" {
+		t.Fatalf("current_database() = %q, want myapp", name)
+	}
+}
+
+func TestSchemaSQL(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: `
+		CREATE TABLE a (id serial PRIMARY KEY);
+		CREATE TABLE b (id serial PRIMARY KEY, a int REFERENCES a);
+		INSERT INTO a DEFAULT VALUES;
+	`})
+	defer pg.Stop()
+
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	defer db.Close()
+	var na, nb int
+	err = db.QueryRow("SELECT (SELECT count(*) FROM a), (SELECT count(*) FROM b)").Scan(&na, &nb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if na != 1 || nb != 0 {
+		t.Fatalf("rows = %d, %d, want 1, 0", na, nb)
+	}
+}
+
+var parseVersionTests = []struct {
+	s    string
+	want string
+}{
+	{"postgres (PostgreSQL) 15.4\n", "15.4"},
+	{"postgres (PostgreSQL) 16.1 (Homebrew)\n", "16.1"},
+	{"postgres (PostgreSQL) 14.9 (Ubuntu 14.9-0ubuntu0.22.04.1)\n", "14.9"},
+	{"postgres (PostgreSQL) 9.6.24\n", "9.6.24"},
+}
+
+func TestParseVersion(t *testing.T) {
+	for _, test := range parseVersionTests {
+		got, err := parseVersion(test.s)
+		if err != nil {
+			t.Errorf("parseVersion(%q): %v", test.s, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseVersion(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+	if _, err := parseVersion("bogus"); err == nil {
+		t.Error("parseVersion(bogus): expected error")
+	}
+}
+
+func TestLogBufferTail(t *testing.T) {
+	b := new(logBuffer)
+	b.Write([]byte("a\nb\nc\n"))
+	for n, want := range []string{"", "c", "b\nc", "a\nb\nc", "a\nb\nc"} {
+		if got := b.tail(n); got != want {
+			t.Errorf("tail(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestStartContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := start(ctx, "", Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	pg := StartWith(t, Options{ListenTCP: true})
+	defer pg.Stop()
+
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	defer db.Close()
+	var addr string
+	err = db.QueryRow("SELECT host(inet_server_addr())").Scan(&addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "127.0.0.1" {
+		t.Fatalf("server address = %q, want 127.0.0.1", addr)
+	}
+}
+
+func TestConfQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"256MB": `'256MB'`,
+		"it's":  `'it''s'`,
+		`C:\x`:  `'C:\\x'`,
+		"":      `''`,
+	} {
+		if got := confQuote(s); got != want {
+			t.Errorf("confQuote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	pg := StartWith(t, Options{Config: map[string]string{
+		"work_mem": "12MB",
+		"fsync":    "on",
+	}})
+	defer pg.Stop()
+
+	for name, want := range map[string]string{"work_mem": "12MB", "fsync": "on"} {
+		var got string
+		err := pg.DB().QueryRow("SHOW " + name).Scan(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDSN(t *testing.T) {
+	pg := &PG{host: "/tmp/pgtest-s123", dbname: "myapp"}
+	want := "postgres:///myapp?host=%2Ftmp%2Fpgtest-s123&sslmode=disable"
+	if got := pg.DSN(); got != want {
+		t.Errorf("DSN() = %q, want %q", got, want)
+	}
+	pg = &PG{host: "127.0.0.1", port: 5433, dbname: "postgres"}
+	want = "postgres://127.0.0.1:5433/postgres?sslmode=disable"
+	if got := pg.DSN(); got != want {
+		t.Errorf("DSN() = %q, want %q", got, want)
+	}
+	pg.user = "admin"
+	want = "postgres://admin@127.0.0.1:5433/postgres?sslmode=disable"
+	if got := pg.DSN(); got != want {
+		t.Errorf("DSN() = %q, want %q", got, want)
+	}
+}
+
+func TestParams(t *testing.T) {
+	pg := &PG{host: "127.0.0.1", port: 5433, dbname: "myapp", user: "admin", password: "sekrit", appName: "TestParams"}
+	want := map[string]string{
+		"host":             "127.0.0.1",
+		"port":             "5433",
+		"dbname":           "myapp",
+		"user":             "admin",
+		"password":         "sekrit",
+		"sslmode":          "disable",
+		"application_name": "TestParams",
+	}
+	if got := pg.Params(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Params() = %v, want %v", got, want)
+	}
+	pg = &PG{host: "/tmp/pgtest-s123", dbname: "postgres"}
+	want = map[string]string{"host": "/tmp/pgtest-s123", "dbname": "postgres", "sslmode": "disable"}
+	if got := pg.Params(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Params() = %v, want %v", got, want)
+	}
+}
+
+func TestSuperuser(t *testing.T) {
+	for _, name := range []string{"", "admin"} {
+		pg := StartWith(t, Options{Superuser: name})
+		var user string
+		err := pg.DB().QueryRow("SELECT current_user").Scan(&user)
+		pg.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := name
+		if want == "" {
+			want = "postgres"
+		}
+		if user != want {
+			t.Errorf("Superuser %q: current_user = %q, want %q", name, user, want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"t":      `"t"`,
+		`a"b`:    `"a""b"`,
+		"x\x00y": `"x"`,
+	} {
+		if got := quoteIdent(s); got != want {
+			t.Errorf("quoteIdent(%q) = %s, want %s", s, got, want)
+		}
+	}
+	for s, want := range map[string]string{
+		"abc":  `'abc'`,
+		`it's`: `'it''s'`,
+		`a\b`:  `E'a\\b'`,
+	} {
+		if got := quoteLiteral(s); got != want {
+			t.Errorf("quoteLiteral(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestDSNQuote(t *testing.T) {
+	for s, want := range map[string]string{
+		"/tmp/pgtest-s1": "/tmp/pgtest-s1",
+		"":               "''",
+		"a b":            "'a b'",
+		`it's`:           `'it\'s'`,
+		`C:\x`:           `'C:\\x'`,
+	} {
+		if got := dsnQuote(s); got != want {
+			t.Errorf("dsnQuote(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	pg := StartWith(t, Options{
+		Password: "sekrit",
+		HBAConf:  "local all all scram-sha-256\nhost all all 127.0.0.1/32 scram-sha-256\n",
+	})
+	defer pg.Stop()
+
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	bad, err := sql.Open("postgres", pg.dsn("postgres")+" password=wrong")
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	defer bad.Close()
+	if err := bad.Ping(); err == nil {
+		t.Fatal("connected with the wrong password")
+	}
+}
+
+func TestDir(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	_, err := os.Stat(filepath.Join(pg.Dir(), "postmaster.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var buf logBuffer
+	pg := StartWith(t, Options{
+		LogWriter: &buf,
+		Config:    map[string]string{"log_statement": "all"},
+	})
+	pg.DB().Exec("SELECT 'pgtest-marker'")
+	pg.Stop()
+	if !strings.Contains(buf.String(), "pgtest-marker") {
+		t.Fatalf("statement not in log:\n%s", buf.String())
+	}
+}
+
+func BenchmarkSelect(b *testing.B) {
+	pg := Start(b)
+	defer pg.Stop()
+
+	db := pg.DB()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		err := db.QueryRow("SELECT 1").Scan(&n)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEarlyExit(t *testing.T) {
+	_, err := start(context.Background(), "", Options{
+		StartTimeout: time.Minute,
+		Config:       map[string]string{"no_such_setting": "1"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "postgres exited unexpectedly") {
+		t.Fatalf("err = %v, want postgres exited unexpectedly", err)
+	}
+}
+
+func TestStartN(t *testing.T) {
+	pgs := StartN(t, 3)
+	defer StopN(pgs)
+
+	seen := make(map[string]bool)
+	for _, pg := range pgs {
+		if seen[pg.URL] {
+			t.Fatalf("duplicate URL %q", pg.URL)
+		}
+		seen[pg.URL] = true
+		if err := pg.DB().Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPreloadLibraries(t *testing.T) {
+	pg := StartWith(t, Options{
+		PreloadLibraries: []string{"pg_stat_statements"},
+		Extensions:       []string{"pg_stat_statements"},
+	})
+	defer pg.Stop()
+
+	var n int
+	err := pg.DB().QueryRow("SELECT count(*) FROM pg_stat_statements").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreloadLibrariesMissing(t *testing.T) {
+	_, err := start(context.Background(), "", Options{
+		PreloadLibraries: []string{"pgtest_no_such_lib"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "pgtest_no_such_lib") {
+		t.Fatalf("err = %v, want error naming the library", err)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+	pg.Stop()
+}
+
+func TestConfigPort(t *testing.T) {
+	pg := StartWith(t, Options{Config: map[string]string{"port": "5499"}})
+	defer pg.Stop()
+
+	if !forceTCP {
+		if _, err := os.Stat(filepath.Join(pg.sockDir, ".s.PGSQL.5499")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var port int
+	err := pg.DB().QueryRow("SELECT current_setting('port')::int").Scan(&port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != 5499 {
+		t.Fatalf("port = %d, want 5499", port)
+	}
+}
+
+func TestSockFile(t *testing.T) {
+	pg := &PG{sockDir: "/tmp/s"}
+	if got, want := pg.sockFile(), "/tmp/s/.s.PGSQL.5432"; got != want {
+		t.Errorf("sockFile() = %q, want %q", got, want)
+	}
+	pg.port = 5499
+	if got, want := pg.sockFile(), "/tmp/s/.s.PGSQL.5499"; got != want {
+		t.Errorf("sockFile() = %q, want %q", got, want)
+	}
+}
+
+func TestUseTmpfs(t *testing.T) {
+	pg := StartWith(t, Options{UseTmpfs: true})
+	defer pg.Stop()
+
+	if base := tmpfsDir(); base != "" && filepath.Dir(pg.Dir()) != base {
+		t.Errorf("data directory %s not in %s", pg.Dir(), base)
+	}
+}
+
+func TestStartTimeout(t *testing.T) {
+	_, err := start(context.Background(), "", Options{StartTimeout: time.Nanosecond})
+	if !errors.Is(err, ErrStartTimeout) {
+		t.Fatalf("err = %v, want ErrStartTimeout", err)
+	}
+}
+
+func TestSkipIfUnavailable(t *testing.T) {
+	SkipIfUnavailable(t)
+	pg := Start(t)
+	pg.Stop()
+}
+
+func TestStatementTimeout(t *testing.T) {
+	pg := StartWith(t, Options{StatementTimeout: 100 * time.Millisecond})
+	defer pg.Stop()
+
+	_, err := pg.DB().Exec("SELECT pg_sleep(10)")
+	if err == nil || !strings.Contains(err.Error(), "statement timeout") {
+		t.Fatalf("err = %v, want statement timeout", err)
+	}
+}
+
+func TestKill(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	if pg.PID() <= 0 {
+		t.Fatalf("PID() = %d", pg.PID())
+	}
+	err := pg.Kill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alive(pg.PID()) {
+		t.Fatal("postgres still running after Kill")
+	}
+	if _, err := os.Stat(pg.Dir()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	_, err := pg.DB().Exec("CREATE TABLE kept (id int); INSERT INTO kept VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := pg.PID()
+	err = pg.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pg.PID() == pid {
+		t.Error("PID unchanged after Restart")
+	}
+	var n int
+	err = pg.DB().QueryRow("SELECT count(*) FROM kept").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("kept has %d rows, want 1", n)
+	}
+}
+
+func TestDurable(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		pg := StartWith(t, Options{Durable: durable})
+		var fsync string
+		err := pg.DB().QueryRow("SHOW fsync").Scan(&fsync)
+		pg.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]string{false: "off", true: "on"}[durable]; fsync != want {
+			t.Errorf("Durable %v: fsync = %s, want %s", durable, fsync, want)
+		}
+	}
+}
+
+func TestLogCollector(t *testing.T) {
+	pg := StartWith(t, Options{LogCollector: true})
+	defer pg.Stop()
+
+	_, err := pg.DB().Exec("DO $$ BEGIN RAISE LOG 'pgtest marker'; END $$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		b, err := ioutil.ReadFile(pg.LogFile())
+		if err == nil && strings.Contains(string(b), "pgtest marker") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log file %s lacks marker: %v\n%s", pg.LogFile(), err, b)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	pg := StartWith(t, Options{Timezone: "Asia/Tokyo"})
+	defer pg.Stop()
+
+	var tz string
+	err := pg.DB().QueryRow("SHOW timezone").Scan(&tz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tz != "Asia/Tokyo" {
+		t.Fatalf("timezone = %q, want Asia/Tokyo", tz)
+	}
+}
+
+func TestStartRetries(t *testing.T) {
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	_, err := startRetry(context.Background(), "", Options{
+		StartRetries: 2,
+		Config:       map[string]string{"no_such_setting": "1"},
+	}, logf)
+	if err == nil {
+		t.Fatal("startRetry succeeded, want error")
+	}
+	if len(logs) != 2 {
+		t.Fatalf("logged %d retries, want 2: %q", len(logs), logs)
+	}
+}
+
+func TestStartRetriesNegative(t *testing.T) {
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	_, err := startRetry(context.Background(), "", Options{
+		StartRetries: -1,
+		Config:       map[string]string{"no_such_setting": "1"},
+	}, logf)
+	if err == nil {
+		t.Fatal("startRetry succeeded, want error")
+	}
+	if len(logs) != 0 {
+		t.Fatalf("logged %d retries, want 0: %q", len(logs), logs)
+	}
+}
+
+func TestStartCleanup(t *testing.T) {
+	var dir string
+	t.Run("sub", func(t *testing.T) {
+		pg := StartCleanup(t)
+		dir = pg.Dir()
+	})
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("data directory %s still exists after cleanup: %v", dir, err)
+	}
+}
+
+func TestAppendConf(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "postgresql.conf")
+	old := "listen_addresses = 'localhost'\t# comment\n#port = 5432\ninclude 'a.conf'\n"
+	err := ioutil.WriteFile(path, []byte(old), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = appendConf(path, []byte("listen_addresses = ''\nport = 1\nPort=2\ninclude 'b.conf'\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#listen_addresses = 'localhost'\t# comment\n#port = 5432\ninclude 'a.conf'\n" +
+		"listen_addresses = ''\n#port = 1\nPort=2\ninclude 'b.conf'\n"
+	if string(b) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b, want)
+	}
+}
+
+func TestPostgresConf(t *testing.T) {
+	pg := StartWith(t, Options{PostgresConf: "work_mem = '7MB'\n"})
+	defer pg.Stop()
+
+	var workMem, fsync string
+	err := pg.DB().QueryRow("SELECT current_setting('work_mem'), current_setting('fsync')").Scan(&workMem, &fsync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if workMem != "7MB" || fsync != "on" {
+		t.Fatalf("work_mem = %s, fsync = %s, want 7MB, on", workMem, fsync)
+	}
+}
+
+func TestPostgresConfListen(t *testing.T) {
+	_, err := start(context.Background(), "", Options{PostgresConf: "listen_addresses = '*'\n"})
+	if err == nil || !strings.Contains(err.Error(), "listen_addresses") {
+		t.Fatalf("err = %v, want error about listen_addresses", err)
+	}
+}
+
+func TestLogical(t *testing.T) {
+	pg := StartWith(t, Options{Logical: true, SchemaSQL: "CREATE TABLE t (n int)"})
+	defer pg.Stop()
+
+	_, err := pg.Exec("SELECT pg_create_logical_replication_slot('test', 'test_decoding')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pg.Exec("INSERT INTO t VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = pg.QueryRow("SELECT count(*) FROM pg_logical_slot_get_changes('test', NULL, NULL)").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("no changes decoded")
+	}
+	_, err = pg.Exec("SELECT pg_drop_replication_slot('test')")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	dir := t.TempDir()
+	pg := StartWith(t, Options{TempDir: dir})
+	defer pg.Stop()
+
+	if filepath.Dir(pg.Dir()) != dir {
+		t.Errorf("data directory %s not in %s", pg.Dir(), dir)
+	}
+}
+
+func TestRestartAfterKill(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	err := pg.Kill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = pg.QueryRow("SELECT 1").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveSockets(t *testing.T) {
+	pg := &PG{sockDir: t.TempDir()}
+	for _, name := range []string{".s.PGSQL.5432", ".s.PGSQL.5432.lock", "other"} {
+		err := ioutil.WriteFile(filepath.Join(pg.sockDir, name), nil, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := pg.removeSockets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := filepath.Glob(filepath.Join(pg.sockDir, "*"))
+	if len(names) != 1 || filepath.Base(names[0]) != "other" {
+		t.Fatalf("left %q, want only other", names)
+	}
+}
+
+func TestDataDir(t *testing.T) {
+	opts := Options{
+		DataDir:   filepath.Join(t.TempDir(), "data"),
+		DBName:    "app",
+		SchemaSQL: "CREATE TABLE t (n int)",
+	}
+	pg := StartWith(t, opts)
+	_, err := pg.Exec("INSERT INTO t VALUES (1)")
+	pg.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(opts.DataDir); err != nil {
+		t.Fatal(err)
+	}
+
+	pg = StartWith(t, opts)
+	defer pg.Stop()
+	var n int
+	err = pg.QueryRow("SELECT count(*) FROM t").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("t has %d rows, want 1", n)
+	}
+}
+
+func TestDataDirFailedSetup(t *testing.T) {
+	opts := Options{
+		DataDir:   filepath.Join(t.TempDir(), "data"),
+		DBName:    "app",
+		SchemaSQL: "CREATE TABLE t (n int)",
+		OnReady: func(db *sql.DB) error {
+			return errors.New("fixture failed")
+		},
+	}
+	_, err := start(context.Background(), "", opts)
+	if err == nil {
+		t.Fatal("start succeeded, want OnReady error")
+	}
+
+	opts.OnReady = nil
+	pg := StartWith(t, opts)
+	defer pg.Stop()
+	var n int
+	err = pg.QueryRow("SELECT count(*) FROM t").Scan(&n)
+	if err != nil {
+		t.Fatal("schema not set up after failed run:", err)
+	}
+}
+
+func TestAppName(t *testing.T) {
+	for name, start := range map[string]func(testing.TB) *PG{
+		"Start": Start,
+		"StartContext": func(t testing.TB) *PG {
+			return StartContext(context.Background(), t)
+		},
+		"StartN": func(t testing.TB) *PG {
+			return StartN(t, 1)[0]
+		},
+		"StartShared": StartShared,
+	} {
+		t.Run(name, func(t *testing.T) {
+			pg := start(t)
+			defer pg.Stop()
+
+			var name string
+			err := pg.QueryRow("SELECT current_setting('application_name')").Scan(&name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != t.Name() {
+				t.Fatalf("application_name = %q, want %q", name, t.Name())
+			}
+		})
+	}
+}
+
+func TestParallelTCP(t *testing.T) {
+	const n = 32
+	pgs := make([]*PG, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range pgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pgs[i], errs[i] = start(context.Background(), "", Options{
+				ListenTCP:    true,
+				StartTimeout: time.Minute,
+			})
+		}(i)
+	}
+	wg.Wait()
+	defer func() {
+		for _, pg := range pgs {
+			if pg != nil {
+				pg.StopErr()
+			}
+		}
+	}()
+	seen := make(map[int]bool)
+	for i, pg := range pgs {
+		if errs[i] != nil {
+			t.Fatalf("instance %d: %v", i, errs[i])
+		}
+		var port int
+		err := pg.withDB(pg.URL, func(db *sql.DB) error {
+			return db.QueryRow("SELECT current_setting('port')::int").Scan(&port)
+		})
+		if err != nil {
+			t.Fatalf("instance %d: %v", i, err)
+		}
+		if port != pg.port || seen[port] {
+			t.Errorf("instance %d: port %d (want %d), seen before: %v", i, port, pg.port, seen[port])
+		}
+		seen[port] = true
+	}
+}
+
+func TestPortInUse(t *testing.T) {
+	pg := &PG{log: new(logBuffer)}
+	io.WriteString(pg.log, `LOG:  could not bind IPv4 address "127.0.0.1": Address already in use
+HINT:  Is another postmaster already running on port 5433? If not, wait a few seconds and retry.
+WARNING:  could not create listen socket for "127.0.0.1"
+FATAL:  could not create any TCP/IP sockets
+LOG:  database system is shut down
+`)
+	if !pg.portInUse() {
+		t.Error("portInUse() = false, want true")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	pg := StartWith(t, Options{Archive: true})
+	defer pg.Stop()
+
+	_, err := pg.Exec("CREATE TABLE t (n int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pg.Exec("SELECT pg_switch_wal()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		names, _ := filepath.Glob(filepath.Join(pg.ArchiveDir(), "*"))
+		if len(names) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing archived in %s\n%s", pg.ArchiveDir(), pg.Log())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestTimings(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	tm := pg.Timings()
+	if tm.Copy <= 0 || tm.Launch <= 0 || tm.Setup <= 0 {
+		t.Fatalf("timings = %+v, want nonzero steps", tm)
+	}
+	if sum := tm.Init + tm.Copy + tm.Launch + tm.Setup; tm.Total < sum {
+		t.Fatalf("total = %v, want at least %v", tm.Total, sum)
+	}
+	if pg.StartDuration() != tm.Total {
+		t.Fatalf("StartDuration = %v, want %v", pg.StartDuration(), tm.Total)
+	}
+}
+
+func TestReadyProbe(t *testing.T) {
+	var calls int
+	pg := StartWith(t, Options{
+		ReadyProbe: func(pg *PG) error {
+			calls++
+			if calls < 3 {
+				return errors.New("not yet")
+			}
+			db, err := sql.Open("postgres", pg.URL)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			return db.Ping()
+		},
+	})
+	defer pg.Stop()
+
+	if calls < 3 {
+		t.Fatalf("probe called %d times, want at least 3", calls)
+	}
+}
+
+func TestDisableJIT(t *testing.T) {
+	pg := StartWith(t, Options{DisableJIT: true})
+	defer pg.Stop()
+
+	jit, err := pg.Setting("jit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jit != "off" {
+		t.Fatalf("jit = %q, want off", jit)
+	}
+}
+
+func TestIsolationLevel(t *testing.T) {
+	pg := StartWith(t, Options{IsolationLevel: "Repeatable Read"})
+	defer pg.Stop()
+
+	level, err := pg.Setting("default_transaction_isolation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level != "repeatable read" {
+		t.Fatalf("isolation = %q, want repeatable read", level)
+	}
+
+	_, err = start(context.Background(), "", Options{IsolationLevel: "serialisable"})
+	if err == nil || !strings.Contains(err.Error(), "isolation level") {
+		t.Fatalf("err = %v, want unknown isolation level", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	done := make(chan error, 1)
+	go func() { done <- pg.Wait() }()
+	select {
+	case err := <-done:
+		t.Fatalf("Wait returned %v while the server was running", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	pg.Stop()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait did not return after Stop")
+	}
+}
+
+func TestAuthMethod(t *testing.T) {
+	pg := StartWith(t, Options{Password: "sekrit", AuthMethod: "scram-sha-256"})
+	defer pg.Stop()
+
+	err := pg.DB().Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := sql.Open("postgres", pg.dsnAs("postgres", "", "wrong"))
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	defer bad.Close()
+	if err := bad.Ping(); err == nil {
+		t.Fatal("connected with the wrong password")
+	}
+
+	_, err = start(context.Background(), "", Options{AuthMethod: "md5"})
+	if err == nil || !strings.Contains(err.Error(), "needs a Password") {
+		t.Fatalf("err = %v, want needs a Password", err)
+	}
+}
+
+func TestDisableAutovacuum(t *testing.T) {
+	pg := StartWith(t, Options{DisableAutovacuum: true})
+	defer pg.Stop()
+
+	v, err := pg.Setting("autovacuum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "off" {
+		t.Fatalf("autovacuum = %q, want off", v)
+	}
+}
+
+func TestReleasePort(t *testing.T) {
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	portMu.Lock()
+	taken := ports[port]
+	portMu.Unlock()
+	if !taken {
+		t.Fatalf("port %d not recorded", port)
+	}
+	releasePort(port)
+	portMu.Lock()
+	taken = ports[port]
+	portMu.Unlock()
+	if taken {
+		t.Fatalf("port %d still recorded after release", port)
+	}
+}
+
+func TestShutdownMode(t *testing.T) {
+	for _, mode := range []ShutdownMode{ShutdownSmart, ShutdownImmediate} {
+		pg := StartWith(t, Options{ShutdownMode: mode})
+		err := pg.DB().Ping()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := pg.Dir()
+		err = pg.StopErr()
+		if err != nil {
+			t.Fatalf("mode %d: %v", mode, err)
+		}
+		select {
+		case <-pg.exited:
+		default:
+			t.Fatalf("mode %d: server still running after Stop", mode)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("mode %d: data dir %s still there: %v", mode, dir, err)
+		}
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	pg := Start(t)
+	defer pg.Stop()
+
+	err := pg.DB().Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.WaitReady(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", pg.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Ping()
+	if err != nil {
+		t.Fatal("second connection:", err)
+	}
+
+	err = pg.Kill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.WaitReady(time.Second)
+	if err == nil {
+		t.Fatal("WaitReady succeeded after Kill")
 	}
 }
@@ -0,0 +1,71 @@
+//go:build !windows
+
+package pgtest
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Socket directories are made directly in /tmp,
+// to keep socket paths short.
+const (
+	sockBase   = "/tmp"
+	sockPrefix = "pgtest-s"
+)
+
+// forceTCP is whether servers must listen on TCP.
+const forceTCP = false
+
+// makeSockDir makes a directory for a server's unix socket.
+// The socket path must fit in sun_path, about 100 bytes,
+// which a data directory under a long TMPDIR might not.
+// Like a data directory, it gets an owner file, so
+// CleanupStale can tell when it has been abandoned.
+func makeSockDir() (string, error) {
+	dir, err := ioutil.TempDir(sockBase, sockPrefix)
+	if err != nil {
+		return "", err
+	}
+	err = writeOwner(dir)
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// archiveCommand returns an archive_command
+// that copies each WAL segment into dir.
+func archiveCommand(dir string) string {
+	dir = "'" + strings.Replace(dir, "'", `'\''`, -1) + "'"
+	return "test ! -f " + dir + "/%f && cp %p " + dir + "/%f"
+}
+
+// shutdown asks the server to shut down in the given mode.
+func (pg *PG) shutdown(mode ShutdownMode) error {
+	sig := os.Interrupt
+	switch mode {
+	case ShutdownSmart:
+		sig = syscall.SIGTERM
+	case ShutdownImmediate:
+		sig = syscall.SIGQUIT
+	}
+	return pg.cmd.Process.Signal(sig)
+}
+
+func interruptProcess(p *os.Process) error {
+	return p.Signal(os.Interrupt)
+}
+
+// alive reports whether process pid exists.
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,104 @@
+package pgtest
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// Windows servers have no unix socket.
+const (
+	sockBase   = ""
+	sockPrefix = ""
+)
+
+// forceTCP is whether servers must listen on TCP.
+const forceTCP = true
+
+func makeSockDir() (string, error) {
+	return "", nil
+}
+
+// archiveCommand returns an archive_command
+// that copies each WAL segment into dir.
+func archiveCommand(dir string) string {
+	return `copy "%p" "` + dir + `\%f"`
+}
+
+// shutdown asks the server to shut down in the given mode.
+// Windows has no SIGINT and friends, so it uses pg_ctl,
+// which signals the server the way postgres expects there.
+func (pg *PG) shutdown(mode ShutdownMode) error {
+	m := "fast"
+	switch mode {
+	case ShutdownSmart:
+		m = "smart"
+	case ShutdownImmediate:
+		m = "immediate"
+	}
+	return exec.Command(pg.inst.pgctl, "stop", "-D", pg.dir, "-m", m, "-W").Run()
+}
+
+func interruptProcess(p *os.Process) error {
+	return errors.New("interrupt not supported on windows")
+}
+
+// processArgs can't read another process's
+// arguments on Windows.
+func processArgs(pid int) ([]string, error) {
+	return nil, errors.New("not supported on windows")
+}
+
+// alive reports whether process pid exists.
+func alive(pid int) bool {
+	const (
+		processQueryLimitedInformation = 0x1000
+		stillActive                    = 259
+	)
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	err = syscall.GetExitCodeProcess(h, &code)
+	return err == nil && code == stillActive
+}
+
+var (
+	kernel32           = syscall.NewLazyDLL("kernel32.dll")
+	getDiskFreeSpaceEx = kernel32.NewProc("GetDiskFreeSpaceExW")
+	lockFileEx         = kernel32.NewProc("LockFileEx")
+)
+
+// diskFree returns the number of bytes available
+// to the current user on the volume holding dir.
+func diskFree(dir string) (uint64, bool) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, false
+	}
+	var free uint64
+	r, _, _ := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	return free, r != 0
+}
+
+// lockFile takes an exclusive lock on the file at path,
+// creating it if need be, waiting for other processes
+// to release it first. Calling unlock releases it.
+func lockFile(path string) (unlock func(), err error) {
+	const lockfileExclusiveLock = 2
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var ol syscall.Overlapped
+	r, _, e := lockFileEx.Call(f.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		f.Close()
+		return nil, e
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,154 @@
+package pgtest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// A Pool keeps servers started ahead of time, so that
+// a test that needs a server of its own can have one
+// at once. Each server is started as StartWith does,
+// with the options given to NewPool.
+type Pool struct {
+	opts  Options
+	ready chan poolResult
+	done  chan struct{} // closed by Shutdown
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup // starts in progress
+}
+
+var errPoolClosed = errors.New("pool is shut down")
+
+type poolResult struct {
+	pg  *PG
+	err error
+}
+
+// NewPool returns a pool that keeps size servers
+// ready, starting them in the background. Options
+// that need a test, such as Verbose, are ignored.
+// Call Shutdown to stop the servers when done.
+// It panics if size is not positive.
+func NewPool(size int, opts Options) *Pool {
+	if size <= 0 {
+		panic("pgtest: pool size must be positive")
+	}
+	opts.Verbose = false
+	p := &Pool{
+		opts:  opts,
+		ready: make(chan poolResult, size),
+		done:  make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		p.fill()
+	}
+	return p
+}
+
+// fill starts a server in the background
+// and adds it to the pool.
+func (p *Pool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		pg, err := start(context.Background(), "", p.opts)
+		p.add(poolResult{pg, err})
+	}()
+}
+
+// add puts r in the pool, or stops its
+// server if the pool is full or shut down.
+func (p *Pool) add(r poolResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		select {
+		case p.ready <- r:
+			return
+		default:
+		}
+	}
+	if r.pg != nil {
+		r.pg.StopErr()
+	}
+}
+
+// Get returns a server from the pool, waiting for one
+// if none is ready yet. Give it back with Put, or stop it
+// with Stop, which starts another in its place.
+// If an error occurs, the test will fail.
+func (p *Pool) Get(t testing.TB) *PG {
+	select {
+	case <-p.done:
+		t.Fatal(errPoolClosed)
+	default:
+	}
+	var r poolResult
+	select {
+	case r = <-p.ready:
+	case <-p.done:
+		t.Fatal(errPoolClosed)
+	}
+	if r.err != nil {
+		p.fill()
+		t.Fatal(r.err)
+	}
+	r.pg.t = t
+	r.pg.pool = p
+	return r.pg
+}
+
+// Put empties the tables in the public schema of pg,
+// as Reset does, and returns it to the pool. Anything
+// else the test changed, such as the schema, is kept.
+// If pg was stopped, or the pool is full or shut down,
+// or the reset fails, pg is stopped instead, and in the
+// last case, as when a test stops pg, the pool starts
+// another to replace it.
+func (p *Pool) Put(pg *PG) {
+	if pg.stopped {
+		return
+	}
+	pg.closeDB()
+	pg.t = nil
+	err := pg.withDB(pg.URL, reset)
+	if err != nil {
+		pg.StopErr() // replaces it
+		return
+	}
+	pg.pool = nil
+	p.add(poolResult{pg: pg})
+}
+
+// Shutdown stops all the servers in the pool, including
+// those still starting. Servers that are out of the pool
+// are for their tests to stop or Put back.
+func (p *Pool) Shutdown() error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	var errs []error
+	for {
+		select {
+		case r := <-p.ready:
+			if r.pg != nil {
+				errs = append(errs, r.pg.StopErr())
+			}
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
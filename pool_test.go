@@ -0,0 +1,92 @@
+package pgtest
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	p := NewPool(2, Options{SchemaSQL: "CREATE TABLE t (n int)"})
+	defer func() {
+		if err := p.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	pg := p.Get(t)
+	_, err := pg.Exec("INSERT INTO t VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Put(pg)
+
+	for i := 0; i < 3; i++ {
+		pg := p.Get(t)
+		var n int
+		err := pg.QueryRow("SELECT count(*) FROM t").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Fatalf("pooled server has %d rows in t, want 0", n)
+		}
+		pg.Stop()
+	}
+}
+
+// fatalTB records a call to Fatal, and
+// ends the goroutine as testing.T does.
+type fatalTB struct {
+	testing.TB
+	failed chan []interface{}
+}
+
+func (tb fatalTB) Fatal(args ...interface{}) {
+	tb.failed <- args
+	runtime.Goexit()
+}
+
+func TestPoolShutdownGet(t *testing.T) {
+	p := NewPool(1, Options{})
+	err := p.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := fatalTB{t, make(chan []interface{}, 1)}
+	go func() { p.Get(tb) }()
+	select {
+	case <-tb.failed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Get blocked after Shutdown")
+	}
+}
+
+func TestNewPoolSize(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("NewPool(0) did not panic")
+		}
+	}()
+	NewPool(0, Options{})
+}
+
+func TestPoolReuse(t *testing.T) {
+	p := NewPool(1, Options{})
+	defer p.Shutdown()
+
+	pg := p.Get(t)
+	p.wg.Wait()
+	if n := len(p.ready); n != 0 {
+		t.Fatalf("after Get, pool has %d servers, want 0", n)
+	}
+	p.Put(pg)
+	if again := p.Get(t); again != pg {
+		t.Fatal("Get after Put returned a different server")
+	}
+	pg.Stop()
+	p.wg.Wait()
+	if n := len(p.ready); n != 1 {
+		t.Fatalf("after Stop, pool has %d servers, want 1", n)
+	}
+}
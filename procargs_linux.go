@@ -0,0 +1,16 @@
+package pgtest
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// processArgs returns the command line of process pid.
+func processArgs(pid int) ([]string, error) {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(string(b), "\x00"), "\x00"), nil
+}
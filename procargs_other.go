@@ -0,0 +1,21 @@
+//go:build !linux && !windows
+
+package pgtest
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// processArgs returns the command line of process pid,
+// as ps reports it. Arguments containing spaces can't
+// be told apart, so a data directory with a space in its
+// path doesn't match, and its server is left running.
+func processArgs(pid int) ([]string, error) {
+	out, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
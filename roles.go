@@ -0,0 +1,81 @@
+package pgtest
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// A RoleSpec describes a role for StartWith to create.
+type RoleSpec struct {
+	Name     string
+	Password string // if empty, the role has none
+	Login    bool   // implied if Password is set
+	CreateDB bool
+
+	// Superuser makes the role a superuser,
+	// bypassing all permission checks.
+	Superuser bool
+
+	// Grants lists privileges to grant the role,
+	// each the text between GRANT and TO, such as
+	// "SELECT ON ALL TABLES IN SCHEMA public"
+	// or "pg_read_all_data". They are granted in
+	// URL's database, after the schema is loaded.
+	Grants []string
+}
+
+// createRoles creates the roles in specs and
+// grants their privileges.
+func (pg *PG) createRoles(specs []RoleSpec) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	return pg.withDB(pg.URL, func(db *sql.DB) error {
+		for _, r := range specs {
+			name := quoteIdent(r.Name)
+			q := "CREATE ROLE " + name
+			if r.Login || r.Password != "" {
+				q += " LOGIN"
+			}
+			if r.CreateDB {
+				q += " CREATEDB"
+			}
+			if r.Superuser {
+				q += " SUPERUSER"
+			}
+			if r.Password != "" {
+				q += " PASSWORD " + quoteLiteral(r.Password)
+			}
+			_, err := db.Exec(q)
+			if err != nil {
+				return fmt.Errorf("role %s: %w", r.Name, err)
+			}
+			for _, g := range r.Grants {
+				_, err = db.Exec("GRANT " + g + " TO " + name)
+				if err != nil {
+					return fmt.Errorf("role %s: grant %s: %w", r.Name, g, err)
+				}
+			}
+		}
+		pg.addRoles(specs)
+		return nil
+	})
+}
+
+// addRoles records the passwords of the roles in specs,
+// for URLAs.
+func (pg *PG) addRoles(specs []RoleSpec) {
+	for _, r := range specs {
+		if pg.roles == nil {
+			pg.roles = make(map[string]string)
+		}
+		pg.roles[r.Name] = r.Password
+	}
+}
+
+// URLAs is like URL, but authenticates as role,
+// with its password if it was created by Options.Roles.
+func (pg *PG) URLAs(role string) string {
+	srv := pg.srv()
+	return pg.withAppName(srv.dsnAs(pg.dbname, role, srv.roles[role]))
+}
@@ -0,0 +1,59 @@
+package pgtest
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	pg := StartWith(t, Options{
+		SchemaSQL: "CREATE TABLE public.secret (x int); CREATE TABLE public.open (x int);",
+		Roles: []RoleSpec{{
+			Name:     "app",
+			Password: "hunter2",
+			Grants:   []string{"SELECT ON public.open"},
+		}},
+	})
+	defer pg.Stop()
+
+	db, err := sql.Open("postgres", pg.URLAs("app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var user string
+	err = db.QueryRow("SELECT current_user").Scan(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "app" {
+		t.Fatalf("current_user = %q, want app", user)
+	}
+	_, err = db.Exec("SELECT * FROM open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("SELECT * FROM secret")
+	if err == nil {
+		t.Fatal("SELECT from secret succeeded, want permission denied")
+	}
+}
+
+func TestDBOwner(t *testing.T) {
+	pg := StartWith(t, Options{
+		DBName:  "owned",
+		Roles:   []RoleSpec{{Name: "owner", Login: true}},
+		DBOwner: "owner",
+	})
+	defer pg.Stop()
+
+	var owner string
+	q := "SELECT pg_get_userbyid(datdba) FROM pg_database WHERE datname = current_database()"
+	err := pg.QueryRow(q).Scan(&owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "owner" {
+		t.Fatalf("owner = %q, want owner", owner)
+	}
+}
@@ -0,0 +1,284 @@
+package pgtest
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// createDB creates database name on server pg.
+// If schema is not empty, the database is cloned
+// from a template database holding that schema,
+// made on first use.
+func (pg *PG) createDB(name, schema string) error {
+	q := "CREATE DATABASE " + quoteIdent(name)
+	if schema != "" {
+		tmpl, err := pg.template(schema)
+		if err != nil {
+			return fmt.Errorf("template: %w", err)
+		}
+		q += " TEMPLATE " + quoteIdent(tmpl)
+	}
+	err := pg.exec("postgres", q)
+	if err != nil {
+		return fmt.Errorf("create database: %w", err)
+	}
+	return nil
+}
+
+// setOwner makes role the owner of the database at URL.
+func (pg *PG) setOwner(role string) error {
+	q := "ALTER DATABASE " + quoteIdent(pg.dbname) + " OWNER TO " + quoteIdent(role)
+	err := pg.exec("postgres", q)
+	if err != nil {
+		return fmt.Errorf("owner %s: %w", role, err)
+	}
+	return nil
+}
+
+// template returns the name of a template database
+// on server pg holding schema, creating it if need be.
+func (pg *PG) template(schema string) (string, error) {
+	pg.tmplMu.Lock()
+	defer pg.tmplMu.Unlock()
+	name := fmt.Sprintf("pgtest_template_%x", sha256.Sum256([]byte(schema)))[:32]
+	if pg.templates[name] {
+		return name, nil
+	}
+	err := pg.exec("postgres", "CREATE DATABASE "+quoteIdent(name))
+	if err != nil {
+		return "", err
+	}
+	err = pg.withDB(pg.dsn(name), func(db *sql.DB) error {
+		return execScript(db, schema)
+	})
+	if err == nil {
+		err = pg.exec("postgres", "ALTER DATABASE "+quoteIdent(name)+" WITH IS_TEMPLATE true")
+	}
+	if err != nil {
+		pg.exec("postgres", "DROP DATABASE "+quoteIdent(name))
+		return "", err
+	}
+	if pg.templates == nil {
+		pg.templates = make(map[string]bool)
+	}
+	pg.templates[name] = true
+	return name, nil
+}
+
+// setupDB prepares the database at pg.URL
+// as described by opts.
+func (pg *PG) setupDB(opts Options) error {
+	if len(opts.Extensions) > 0 {
+		err := pg.withDB(pg.URL, func(db *sql.DB) error {
+			return createExtensions(db, opts.Extensions)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if opts.SchemaFile != "" || opts.SchemaSQL != "" {
+		err := pg.withDB(pg.URL, func(db *sql.DB) error {
+			return loadSchema(db, opts)
+		})
+		if err != nil {
+			return fmt.Errorf("schema: %w", err)
+		}
+	}
+	if opts.MigrationsDir != "" {
+		err := pg.withDB(pg.URL, func(db *sql.DB) error {
+			return migrate(db, opts.MigrationsDir)
+		})
+		if err != nil {
+			return fmt.Errorf("migrate: %w", err)
+		}
+	}
+	if opts.DumpFile != "" {
+		err := pg.restore(opts.DumpFile)
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", opts.DumpFile, err)
+		}
+	}
+	return nil
+}
+
+// migrate runs the up migrations in dir.
+func migrate(db *sql.DB, dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*.up.sql"))
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no *.up.sql files in %s", dir)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		err = execScript(db, string(b))
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(name), err)
+		}
+	}
+	return nil
+}
+
+// createExtensions creates each of the named extensions.
+func createExtensions(db *sql.DB, names []string) error {
+	for _, name := range names {
+		_, err := db.Exec("CREATE EXTENSION IF NOT EXISTS " + quoteIdent(name))
+		if code := sqlState(err); code == "58P01" || code == "0A000" {
+			// undefined_file or feature_not_supported:
+			// the extension's files aren't installed.
+			return fmt.Errorf("extension %s is not installed: %w", name, err)
+		}
+		if err != nil {
+			return fmt.Errorf("create extension %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// loadSchema runs the SQL in opts.SchemaFile
+// and opts.SchemaSQL, in that order.
+func loadSchema(db *sql.DB, opts Options) error {
+	if opts.SchemaFile != "" {
+		b, err := ioutil.ReadFile(opts.SchemaFile)
+		if err != nil {
+			return err
+		}
+		err = execScript(db, string(b))
+		if err != nil {
+			return fmt.Errorf("%s: %w", opts.SchemaFile, err)
+		}
+	}
+	return execScript(db, opts.SchemaSQL)
+}
+
+// execScript runs each statement in script in turn,
+// stopping at the first error.
+func execScript(db *sql.DB, script string) error {
+	for _, stmt := range splitSQL(script) {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// splitSQL splits script into statements at semicolons,
+// ignoring semicolons inside quotes, dollar-quoted strings,
+// and comments.
+func splitSQL(script string) []string {
+	var stmts []string
+	start := 0
+	for i := 0; i < len(script); {
+		switch c := script[i]; {
+		case c == '\'':
+			esc := i > 0 && (script[i-1] == 'E' || script[i-1] == 'e')
+			i = skipQuoted(script, i, '\'', esc)
+		case c == '"':
+			i = skipQuoted(script, i, '"', false)
+		case strings.HasPrefix(script[i:], "--"):
+			n := strings.IndexByte(script[i:], '\n')
+			if n < 0 {
+				n = len(script) - i
+			}
+			i += n
+		case strings.HasPrefix(script[i:], "/*"):
+			i = skipComment(script, i)
+		case c == '$':
+			tag := dollarTag(script[i:])
+			if tag == "" {
+				i++
+				break
+			}
+			n := strings.Index(script[i+len(tag):], tag)
+			if n < 0 {
+				i = len(script)
+			} else {
+				i += len(tag) + n + len(tag)
+			}
+		case c == ';':
+			if s := strings.TrimSpace(script[start:i]); s != "" {
+				stmts = append(stmts, s)
+			}
+			i++
+			start = i
+		default:
+			i++
+		}
+	}
+	if s := strings.TrimSpace(script[start:]); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
+
+// skipQuoted returns the index just past the string
+// or identifier quoted by q that starts at script[i].
+// A doubled quote character stands for itself,
+// and if esc is set, so does a backslash-escaped one.
+func skipQuoted(script string, i int, q byte, esc bool) int {
+	for i++; i < len(script); i++ {
+		switch script[i] {
+		case '\\':
+			if esc {
+				i++
+			}
+		case q:
+			if i+1 < len(script) && script[i+1] == q {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return i
+}
+
+// skipComment returns the index just past the
+// (possibly nested) block comment at script[i].
+func skipComment(script string, i int) int {
+	depth := 0
+	for i < len(script) {
+		switch {
+		case strings.HasPrefix(script[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(script[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return i
+}
+
+// dollarTag returns the dollar-quote tag, such as $$
+// or $body$, at the start of s, or "" if there is none.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 1:
+		default:
+			return ""
+		}
+	}
+	return ""
+}
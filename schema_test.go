@@ -0,0 +1,99 @@
+package pgtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var splitSQLTests = []struct {
+	script string
+	want   []string
+}{
+	{"", nil},
+	{"SELECT 1", []string{"SELECT 1"}},
+	{"SELECT 1; SELECT 2;\n", []string{"SELECT 1", "SELECT 2"}},
+	{"SELECT ';'; SELECT 2", []string{"SELECT ';'", "SELECT 2"}},
+	{"SELECT 'it''s;'", []string{"SELECT 'it''s;'"}},
+	{`SELECT E'\';'`, []string{`SELECT E'\';'`}},
+	{`CREATE TABLE "a;b" (x int)`, []string{`CREATE TABLE "a;b" (x int)`}},
+	{"SELECT 1 -- one; two\n; SELECT 2", []string{"SELECT 1 -- one; two", "SELECT 2"}},
+	{"SELECT /* a /* ; */ ; */ 1", []string{"SELECT /* a /* ; */ ; */ 1"}},
+	{
+		"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql; SELECT f()",
+		[]string{"CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql", "SELECT f()"},
+	},
+	{
+		"DO $body$ BEGIN PERFORM 1; END $body$; SELECT $1",
+		[]string{"DO $body$ BEGIN PERFORM 1; END $body$", "SELECT $1"},
+	},
+}
+
+func TestSplitSQL(t *testing.T) {
+	for _, test := range splitSQLTests {
+		got := splitSQL(test.script)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitSQL(%q) = %q, want %q", test.script, got, test.want)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	pg := StartWith(t, Options{Extensions: []string{"pg_trgm"}})
+	defer pg.Stop()
+
+	var sim float64
+	err := pg.DB().QueryRow("SELECT similarity('word', 'two words')").Scan(&sim)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtensionMissing(t *testing.T) {
+	_, err := start(context.Background(), "", Options{Extensions: []string{"no_such_ext"}})
+	if err == nil || !strings.Contains(err.Error(), "extension no_such_ext is not installed") {
+		t.Fatalf("err = %v, want extension not installed", err)
+	}
+}
+
+func TestMigrationsDir(t *testing.T) {
+	pg := StartWith(t, Options{MigrationsDir: "testdata/migrations"})
+	defer pg.Stop()
+
+	_, err := pg.DB().Exec("INSERT INTO users (name, email) VALUES ('a', 'a@example.com')")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnReady(t *testing.T) {
+	pg := StartWith(t, Options{
+		SchemaSQL: "CREATE TABLE t (n int)",
+		OnReady: func(db *sql.DB) error {
+			_, err := db.Exec("INSERT INTO t VALUES (42)")
+			return err
+		},
+	})
+	defer pg.Stop()
+
+	var n int
+	err := pg.QueryRow("SELECT n FROM t").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 42 {
+		t.Fatalf("n = %d, want 42", n)
+	}
+}
+
+func TestOnReadyError(t *testing.T) {
+	_, err := start(context.Background(), "", Options{
+		OnReady: func(db *sql.DB) error { return errors.New("boom") },
+	})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("err = %v, want boom", err)
+	}
+}
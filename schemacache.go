@@ -0,0 +1,146 @@
+package pgtest
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// schemaCache returns a directory holding a copy of the
+// initdb output in data with the database described by
+// opts already set up, building it if need be. Its name
+// is data's plus a hash of the schema, so later runs
+// find it, just as they find data.
+func schemaCache(ctx context.Context, data string, opts Options) (string, error) {
+	sum, err := schemaSum(opts)
+	if err != nil {
+		return "", err
+	}
+	dir := fmt.Sprintf("%s-schema-%x", data, sum[:6])
+	cacheMu.Lock()
+	c := caches[dir]
+	if c == nil {
+		c = new(cache)
+		caches[dir] = c
+	}
+	cacheMu.Unlock()
+	c.once.Do(func() { c.err = buildSchemaCache(ctx, dir, data, opts) })
+	return dir, c.err
+}
+
+// buildSchemaCache starts a server as opts says, stops it,
+// and moves a copy of its data directory to dir, unless
+// dir already exists. The configuration files are those
+// in data, so the copy can stand in for it.
+func buildSchemaCache(ctx context.Context, dir, data string, opts Options) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	unlock, err := lockFile(dir + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(dir); err == nil {
+		return nil // made while we waited
+	}
+	opts.CacheSchema = false
+	opts.Roles = nil
+	opts.DBOwner = ""
+	opts.OnReady = nil // run on each server instead
+	opts.AutoAnalyze = false
+	opts.LogWriter = nil
+	opts.LogCollector = false
+	opts.KeepOnFailure = false
+	opts.StatementTimeout = 0
+	opts.LockTimeout = 0
+	opts.DataDir = "" // the cache is its own data directory
+	opts.Archive = false
+	pg, err := start(ctx, "", opts)
+	if err != nil {
+		return fmt.Errorf("schema cache: %w", err)
+	}
+	defer pg.StopErr()
+	err = pg.halt(ShutdownFast)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), filepath.Base(dir)+"-tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp) // no-op once renamed
+	err = copyDir(pg.dir, tmp)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"postgresql.conf", "pg_hba.conf"} {
+		err = os.Remove(filepath.Join(tmp, name))
+		if err != nil {
+			return err
+		}
+		err = copyFile(filepath.Join(data, name), filepath.Join(tmp, name), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	err = os.Rename(tmp, dir)
+	if err != nil {
+		if _, err1 := os.Stat(dir); err1 == nil {
+			return nil // another process got there first
+		}
+		return err
+	}
+	return nil
+}
+
+// schemaSum returns a hash of the options that
+// determine the database's contents, including
+// the contents of the files they name.
+func schemaSum(opts Options) ([]byte, error) {
+	h := sha256.New()
+	for _, s := range append([]string{opts.DBName, opts.Template, opts.SchemaSQL}, opts.Extensions...) {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	for _, path := range []string{opts.SchemaFile, opts.MigrationsDir, opts.DumpFile} {
+		h.Write([]byte{1})
+		if path == "" {
+			continue
+		}
+		err := hashTree(h, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// hashTree writes the names and contents of the
+// regular files in the tree rooted at root to h.
+func hashTree(h hash.Hash, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		io.WriteString(h, rel)
+		h.Write([]byte{0})
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+}
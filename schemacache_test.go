@@ -0,0 +1,63 @@
+package pgtest
+
+import (
+	"bytes"
+	"database/sql"
+	"testing"
+)
+
+func TestCacheSchema(t *testing.T) {
+	opts := Options{
+		CacheDir:    t.TempDir(),
+		CacheSchema: true,
+		DBName:      "app",
+		SchemaSQL:   "CREATE TABLE t (n int); INSERT INTO t VALUES (1);",
+	}
+	for i := 0; i < 2; i++ {
+		pg := StartWith(t, opts)
+		var n int
+		err := pg.DB().QueryRow("SELECT count(*) FROM t").Scan(&n)
+		pg.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("run %d: t has %d rows, want 1", i, n)
+		}
+	}
+}
+
+func TestCacheSchemaOnReady(t *testing.T) {
+	opts := Options{
+		CacheDir:    t.TempDir(),
+		CacheSchema: true,
+		DBName:      "app",
+		SchemaSQL:   "CREATE TABLE t (n int)",
+		OnReady: func(db *sql.DB) error {
+			_, err := db.Exec("CREATE TABLE fixture (n int)")
+			return err
+		},
+	}
+	for i := 0; i < 2; i++ {
+		pg := StartWith(t, opts)
+		pg.Stop()
+	}
+}
+
+func TestSchemaSum(t *testing.T) {
+	a, err := schemaSum(Options{SchemaSQL: "CREATE TABLE a ()"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := schemaSum(Options{SchemaSQL: "CREATE TABLE b ()"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := schemaSum(Options{MigrationsDir: "testdata/migrations"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, b) || bytes.Equal(a, c) {
+		t.Error("schema sums not distinct")
+	}
+}
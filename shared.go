@@ -0,0 +1,141 @@
+package pgtest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	sharedMu  sync.Mutex
+	sharedPG  *PG // nil until first needed
+	sharedSeq int
+)
+
+// StartShared returns a PG whose URL refers to a new, empty
+// database on a postgres server shared by all callers in the
+// process. This is much faster than starting a fresh server
+// for every test, while still giving each test its own database.
+// The shared server is started on first use, and runs until
+// Shutdown is called.
+// If an error occurs, the test will fail.
+func StartShared(t testing.TB) *PG {
+	return StartSharedWith(t, Options{})
+}
+
+// StartSharedWith is like StartShared, but prepares the new
+// database as described by opts. Only the options that apply
+// to a database, rather than to the server as a whole, are
+// used: Template, Extensions, SchemaFile, SchemaSQL,
+// MigrationsDir, DumpFile, Driver, AppName, and OnReady.
+func StartSharedWith(t testing.TB, opts Options) *PG {
+	if opts.AppName == "" {
+		opts.AppName = t.Name()
+	}
+	pg, err := startShared(opts, t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg.t = t
+	return pg
+}
+
+func startShared(opts Options, test string) (*PG, error) {
+	sharedMu.Lock()
+	if sharedPG == nil {
+		pg, err := StartErr("")
+		if err != nil {
+			sharedMu.Unlock()
+			return nil, err
+		}
+		sharedPG = pg
+	}
+	server := sharedPG
+	sharedSeq++
+	name := sharedDBName(test, sharedSeq)
+	sharedMu.Unlock()
+
+	err := server.createDB(name, opts.Template)
+	if err != nil {
+		return nil, err
+	}
+	pg := &PG{
+		URL:     server.dsn(name),
+		driver:  opts.Driver,
+		server:  server,
+		dbname:  name,
+		appName: opts.AppName,
+	}
+	err = pg.setupDB(opts)
+	if err == nil {
+		err = pg.onReady(opts.OnReady)
+	}
+	if err != nil {
+		pg.StopErr()
+		return nil, err
+	}
+	pg.URL = pg.withAppName(pg.URL)
+	return pg, nil
+}
+
+// maxIdent is the longest identifier postgres allows, in bytes.
+const maxIdent = 63
+
+// sharedDBName returns a name for database seq on the shared
+// server, for the test named test. It includes as much of
+// the test's name as fits, for recognition, with anything
+// but letters and digits replaced by underscores. The
+// sequence number, at the end, makes it unique.
+func sharedDBName(test string, seq int) string {
+	suffix := fmt.Sprintf("_%d", seq)
+	b := []byte("pgtest_")
+	for _, c := range []byte(strings.ToLower(test)) {
+		if len(b) >= maxIdent-len(suffix) {
+			break
+		}
+		if 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
+			b = append(b, c)
+		} else {
+			b = append(b, '_')
+		}
+	}
+	return string(b) + suffix
+}
+
+// Main runs the tests in m, then stops the shared server,
+// for use in TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(pgtest.Main(m))
+//	}
+//
+// Tests then call StartShared to get a database of their
+// own on the server, which starts the first time it's needed.
+// Main returns the exit code from m.Run, or 1 if the
+// tests passed but stopping the server failed.
+func Main(m *testing.M) int {
+	code := m.Run()
+	if err := Shutdown(); err != nil {
+		fmt.Fprintln(os.Stderr, "pgtest:", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+// Shutdown stops the shared server started by StartShared,
+// if it is running. Call it once all tests are done with it,
+// for example in TestMain after m.Run returns.
+func Shutdown() error {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	if sharedPG == nil {
+		return nil
+	}
+	err := sharedPG.StopErr()
+	sharedPG = nil
+	return err
+}
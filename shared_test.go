@@ -0,0 +1,111 @@
+package pgtest
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestShared(t *testing.T) {
+	defer Shutdown()
+	a := StartShared(t)
+	b := StartShared(t)
+	if a.URL == b.URL {
+		t.Fatalf("shared databases have same URL %q", a.URL)
+	}
+	a.Stop()
+
+	db, err := sql.Open("postgres", b.URL)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	_, err = db.Exec("CREATE TABLE t (x int)")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Stop()
+}
+
+func TestSharedTemplate(t *testing.T) {
+	defer Shutdown()
+	const schema = "CREATE TABLE t (x int); INSERT INTO t VALUES (1)"
+	for i := 0; i < 3; i++ {
+		pg := StartSharedWith(t, Options{Template: schema})
+		var n int
+		err := pg.DB().QueryRow("SELECT count(*) FROM t").Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Fatalf("count = %d, want 1", n)
+		}
+		pg.Stop()
+	}
+}
+
+func TestCreateDB(t *testing.T) {
+	defer Shutdown()
+	pg := StartShared(t)
+	url := pg.CreateDB("reporting")
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	err = db.Ping()
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pg.Stop()
+
+	// Stop must have dropped it; creating it again would fail otherwise.
+	pg = StartShared(t)
+	defer pg.Stop()
+	pg.CreateDB("reporting")
+	pg.DropDB("reporting")
+}
+
+func TestSharedDBName(t *testing.T) {
+	names := []string{
+		"TestFoo",
+		"TestFoo/sub",
+		"TestFoo/sub_",
+		"TestFoo/with spaces and ünïcödé",
+		"TestBar/" + strings.Repeat("x", 100),
+		"TestBar/" + strings.Repeat("x", 101),
+	}
+	seen := make(map[string]bool)
+	for i, test := range names {
+		name := sharedDBName(test, i+1)
+		if len(name) > maxIdent {
+			t.Errorf("sharedDBName(%q) = %q, longer than %d bytes", test, name, maxIdent)
+		}
+		for _, c := range name {
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '_') {
+				t.Errorf("sharedDBName(%q) = %q, has %q", test, name, c)
+				break
+			}
+		}
+		if seen[name] {
+			t.Errorf("sharedDBName(%q) = %q, seen before", test, name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestSharedName(t *testing.T) {
+	defer Shutdown()
+	t.Run("a b/c", func(t *testing.T) {
+		pg := StartShared(t)
+		defer pg.Stop()
+		var name string
+		err := pg.QueryRow("SELECT current_database()").Scan(&name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(name, "pgtest_testsharedname_a_b_c_") {
+			t.Fatalf("current_database() = %q", name)
+		}
+	})
+}
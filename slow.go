@@ -0,0 +1,58 @@
+package pgtest
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A SlowQuery is a statement the server logged
+// for taking longer than Options.SlowQueryThreshold.
+type SlowQuery struct {
+	Duration  time.Duration
+	Statement string // such as "statement: SELECT 1"
+}
+
+// SlowQueries returns the statements logged so far for
+// taking longer than Options.SlowQueryThreshold, so a test
+// can check that none did. For a PG returned by StartShared,
+// it includes the statements of every test on the server.
+func (pg *PG) SlowQueries() ([]SlowQuery, error) {
+	log := pg.Log()
+	if f := pg.LogFile(); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		log = string(b)
+	}
+	return parseSlowQueries(log), nil
+}
+
+// parseSlowQueries finds the lines of a server log
+// written for log_min_duration_statement, which look like
+//
+//	LOG:  duration: 12.345 ms  statement: SELECT 1
+func parseSlowQueries(log string) []SlowQuery {
+	var qs []SlowQuery
+	for _, line := range strings.Split(log, "\n") {
+		i := strings.Index(line, "duration: ")
+		if i < 0 {
+			continue
+		}
+		f := strings.SplitN(line[i+len("duration: "):], " ms", 2)
+		if len(f) != 2 {
+			continue
+		}
+		ms, err := strconv.ParseFloat(f[0], 64)
+		if err != nil {
+			continue
+		}
+		qs = append(qs, SlowQuery{
+			Duration:  time.Duration(ms * float64(time.Millisecond)),
+			Statement: strings.TrimSpace(f[1]),
+		})
+	}
+	return qs
+}
@@ -0,0 +1,46 @@
+package pgtest
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSlowQueries(t *testing.T) {
+	log := "2024-01-02 03:04:05.678 UTC [42] LOG:  duration: 12.5 ms  statement: SELECT 1\n" +
+		"2024-01-02 03:04:05.678 UTC [42] LOG:  checkpoint starting: time\n"
+	got := parseSlowQueries(log)
+	if len(got) != 1 {
+		t.Fatalf("got %d queries, want 1: %+v", len(got), got)
+	}
+	if got[0].Duration != 12500*time.Microsecond {
+		t.Errorf("duration = %v, want 12.5ms", got[0].Duration)
+	}
+	if got[0].Statement != "statement: SELECT 1" {
+		t.Errorf("statement = %q", got[0].Statement)
+	}
+}
+
+func TestSlowQueries(t *testing.T) {
+	pg := StartWith(t, Options{SlowQueryThreshold: 100 * time.Millisecond})
+	defer pg.Stop()
+
+	_, err := pg.Exec("SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pg.Exec("SELECT pg_sleep(0.2)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs, err := pg.SlowQueries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != 1 || !strings.Contains(qs[0].Statement, "pg_sleep") {
+		t.Fatalf("slow queries = %+v, want just pg_sleep", qs)
+	}
+	if qs[0].Duration < 200*time.Millisecond {
+		t.Fatalf("duration = %v, want at least 200ms", qs[0].Duration)
+	}
+}
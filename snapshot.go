@@ -0,0 +1,93 @@
+package pgtest
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A Snapshot is a copy of a server's data directory,
+// made by PG.Snapshot.
+type Snapshot struct {
+	dir string
+}
+
+var errShared = errors.New("not supported for a database on the shared server")
+
+// Snapshot records the current state of the server,
+// for Restore to return to later. It shuts down the
+// server so that the state on disk is consistent,
+// copies the data directory, and starts the server again.
+// Existing connections are closed in the process.
+// Snapshots are removed by Stop.
+func (pg *PG) Snapshot() (Snapshot, error) {
+	if pg.server != nil {
+		return Snapshot{}, errShared
+	}
+	pg.closeDB()
+	err := pg.halt(ShutdownFast)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	// The name fits the pattern of our data directories,
+	// and it gets an owner file, so CleanupStale takes
+	// care of snapshots that outlive their owner.
+	dir, err := ioutil.TempDir(filepath.Dir(pg.dir), "pgtest")
+	if err != nil {
+		return Snapshot{}, err
+	}
+	err = writeOwner(dir)
+	if err == nil {
+		err = copyDir(pg.dir, dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return Snapshot{}, err
+	}
+	s := Snapshot{dir}
+	pg.snapshots = append(pg.snapshots, s)
+	return s, pg.launch()
+}
+
+// Restore returns the server to the state recorded in s.
+// It shuts down the server, replaces its data directory
+// with a copy of s, and starts the server again, with the
+// same URL. Existing connections are closed in the process.
+// A snapshot can be restored more than once.
+func (pg *PG) Restore(s Snapshot) error {
+	if pg.server != nil {
+		return errShared
+	}
+	pg.closeDB()
+	err := pg.halt(ShutdownFast)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(pg.dir)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(pg.dir, 0700)
+	if err != nil {
+		return err
+	}
+	if !pg.persist {
+		err = writeOwner(pg.dir)
+		if err != nil {
+			return err
+		}
+	}
+	err = copyDir(s.dir, pg.dir)
+	if err != nil {
+		return err
+	}
+	return pg.launch()
+}
+
+func (pg *PG) removeSnapshots() {
+	for _, s := range pg.snapshots {
+		os.RemoveAll(s.dir)
+	}
+	pg.snapshots = nil
+}
@@ -0,0 +1,33 @@
+package pgtest
+
+import "testing"
+
+func TestSnapshot(t *testing.T) {
+	pg := StartWith(t, Options{SchemaSQL: "CREATE TABLE t (x int)"})
+	defer pg.Stop()
+
+	_, err := pg.DB().Exec("INSERT INTO t VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := pg.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pg.DB().Exec("INSERT INTO t VALUES (2); DROP TABLE t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pg.Restore(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = pg.DB().QueryRow("SELECT count(*) FROM t").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("after Restore, t has %d rows, want 1", n)
+	}
+}
@@ -0,0 +1,212 @@
+package pgtest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ownerFile, in each temporary data directory,
+// holds the process ID of the program that created it.
+const ownerFile = "pgtest.owner"
+
+// archivePrefix begins the names of WAL archive
+// directories, made alongside data directories.
+const archivePrefix = "pgtest-wal"
+
+// keepFile marks a data directory kept by KeepOnFailure,
+// and the socket and archive directories its config names.
+const keepFile = "pgtest.keep"
+
+func writeOwner(dir string) error {
+	pid := strconv.Itoa(os.Getpid())
+	return ioutil.WriteFile(filepath.Join(dir, ownerFile), []byte(pid+"\n"), 0666)
+}
+
+// CleanupStale removes data, WAL archive, and socket
+// directories left behind by earlier programs that exited
+// without calling Stop, for instance because a test
+// panicked or was killed.
+// If a leftover postgres server is still running in such a
+// directory, CleanupStale shuts it down first. Directories
+// belonging to running programs are left alone.
+//
+// Start calls CleanupStale the first time it runs.
+func CleanupStale() error {
+	names, err := filepath.Glob(filepath.Join(os.TempDir(), "pgtest*"))
+	if err != nil {
+		return err
+	}
+	for _, base := range []string{os.Getenv("PGTEST_TMPDIR"), tmpfsBase} {
+		if base != "" {
+			more, _ := filepath.Glob(filepath.Join(base, "pgtest*"))
+			names = append(names, more...)
+		}
+	}
+	var firstErr error
+	for _, dir := range names {
+		name := filepath.Base(dir)
+		switch {
+		case isStale(filepath.Dir(dir), name):
+			if pid, ok := readPID(filepath.Join(dir, "postmaster.pid")); ok && alive(pid) {
+				if !isPostmaster(pid, dir) {
+					// Perhaps the PID was reused after a reboot.
+					// Don't signal a process we can't vouch for,
+					// nor remove a directory it might be using.
+					continue
+				}
+				terminate(pid)
+			}
+		case strings.HasPrefix(name, archivePrefix) && isStaleArchive(dir):
+		default:
+			continue
+		}
+		err := os.RemoveAll(dir)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if sockBase == "" {
+		return firstErr
+	}
+	socks, err := filepath.Glob(filepath.Join(sockBase, sockPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range socks {
+		if !isStaleSock(dir) {
+			continue
+		}
+		err := os.RemoveAll(dir)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// isTempDirName reports whether name has the form
+// ioutil.TempDir gives our data directories.
+func isTempDirName(name string) bool {
+	digits := strings.TrimPrefix(name, "pgtest")
+	if digits == "" {
+		return false
+	}
+	_, err := strconv.ParseUint(digits, 10, 64)
+	return err == nil
+}
+
+// isStale reports whether name, in directory base, is one
+// of our postgres data directories whose owning program is
+// no longer running. A directory that hasn't been populated
+// yet is never stale; its owner is still setting it up.
+// Nor is one kept deliberately, or one with no owner file,
+// which might be mid-copy.
+func isStale(base, name string) bool {
+	if !isTempDirName(name) {
+		return false
+	}
+	dir := filepath.Join(base, name)
+	if _, err := os.Stat(filepath.Join(dir, "PG_VERSION")); err != nil {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(dir, keepFile)); err == nil {
+		return false
+	}
+	pid, ok := readPID(filepath.Join(dir, ownerFile))
+	return ok && pid != os.Getpid() && !alive(pid)
+}
+
+// isStaleArchive reports whether dir is a WAL archive
+// directory whose owning program is no longer running.
+// One without an owner file is still being set up,
+// and one kept deliberately is not stale.
+func isStaleArchive(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, keepFile)); err == nil {
+		return false
+	}
+	pid, ok := readPID(filepath.Join(dir, ownerFile))
+	return ok && pid != os.Getpid() && !alive(pid)
+}
+
+// isStaleSock reports whether dir is a socket directory
+// whose owning program is no longer running, and which
+// no running server is using. One without an owner file,
+// from an older version, is stale once it has a socket
+// lock file naming a process that has exited. One kept
+// deliberately is not stale.
+func isStaleSock(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, keepFile)); err == nil {
+		return false
+	}
+	locks, _ := filepath.Glob(filepath.Join(dir, ".s.PGSQL.*.lock"))
+	for _, lock := range locks {
+		if pid, ok := readPID(lock); ok && alive(pid) {
+			return false
+		}
+	}
+	pid, ok := readPID(filepath.Join(dir, ownerFile))
+	if !ok {
+		return len(locks) > 0
+	}
+	return pid != os.Getpid() && !alive(pid)
+}
+
+// isPostmaster reports whether process pid is a postgres
+// server for data directory dir, as named both by the
+// second line of dir's postmaster.pid and by the
+// process's -D argument.
+func isPostmaster(pid int, dir string) bool {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "postmaster.pid"))
+	if err != nil {
+		return false
+	}
+	lines := strings.Split(string(b), "\n")
+	if len(lines) < 2 || filepath.Clean(lines[1]) != filepath.Clean(dir) {
+		return false
+	}
+	args, err := processArgs(pid)
+	if err != nil {
+		return false
+	}
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-D" && filepath.Clean(args[i+1]) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// readPID reads a process ID from the first line of file name.
+func readPID(name string) (int, bool) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, false
+	}
+	line := strings.SplitN(string(b), "\n", 2)[0]
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	return pid, err == nil && pid > 0
+}
+
+// terminate shuts down the server with process ID pid,
+// killing it if it doesn't exit within stopTimeout.
+func terminate(pid int) {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+	if interruptProcess(p) != nil {
+		p.Kill()
+		return
+	}
+	deadline := time.Now().Add(stopTimeout)
+	for alive(pid) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if alive(pid) {
+		p.Kill()
+	}
+}
@@ -0,0 +1,143 @@
+package pgtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestIsStale(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "pgtest123")
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isStale(base, "pgtest123") {
+		t.Error("empty dir is stale")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("15\n"), 0666)
+	if isStale(base, "pgtest123") {
+		t.Error("dir without owner is stale")
+	}
+	writeOwner(dir)
+	if isStale(base, "pgtest123") {
+		t.Error("dir owned by this process is stale")
+	}
+	ioutil.WriteFile(filepath.Join(dir, ownerFile), []byte("999999999\n"), 0666)
+	if !isStale(base, "pgtest123") {
+		t.Error("dir owned by dead process is not stale")
+	}
+	err = os.Rename(dir, filepath.Join(base, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isStale(base, "other") {
+		t.Error("dir not named by TempDir is stale")
+	}
+}
+
+func TestIsTempDirName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"pgtest123456":          true,
+		"pgtest":                false,
+		"pgtestdata1-15.4-abcd": false,
+		"pgtest-foo":            false,
+	} {
+		if got := isTempDirName(name); got != want {
+			t.Errorf("isTempDirName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestIsStaleKept(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "pgtest123")
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "PG_VERSION"), []byte("15\n"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, keepFile), nil, 0666)
+	if isStale(base, "pgtest123") {
+		t.Error("kept dir is stale")
+	}
+}
+
+func TestIsStaleSock(t *testing.T) {
+	dir := t.TempDir()
+	if isStaleSock(dir) {
+		t.Error("empty dir without owner is stale")
+	}
+	writeOwner(dir)
+	if isStaleSock(dir) {
+		t.Error("dir owned by this process is stale")
+	}
+	// A server shut down cleanly, removing its socket,
+	// and then its owner died.
+	ioutil.WriteFile(filepath.Join(dir, ownerFile), []byte("999999999\n"), 0666)
+	if !isStaleSock(dir) {
+		t.Error("empty dir owned by dead process is not stale")
+	}
+	ioutil.WriteFile(filepath.Join(dir, keepFile), nil, 0666)
+	if isStaleSock(dir) {
+		t.Error("kept dir is stale")
+	}
+	os.Remove(filepath.Join(dir, keepFile))
+	lock := fmt.Sprintf("%d\n", os.Getpid())
+	ioutil.WriteFile(filepath.Join(dir, ".s.PGSQL.5432.lock"), []byte(lock), 0666)
+	if isStaleSock(dir) {
+		t.Error("dir with a live server's lock is stale")
+	}
+}
+
+func TestIsStaleArchive(t *testing.T) {
+	dir := t.TempDir()
+	if isStaleArchive(dir) {
+		t.Error("dir without owner is stale")
+	}
+	writeOwner(dir)
+	if isStaleArchive(dir) {
+		t.Error("dir owned by this process is stale")
+	}
+	ioutil.WriteFile(filepath.Join(dir, ownerFile), []byte("999999999\n"), 0666)
+	if !isStaleArchive(dir) {
+		t.Error("dir owned by dead process is not stale")
+	}
+	ioutil.WriteFile(filepath.Join(dir, keepFile), nil, 0666)
+	if isStaleArchive(dir) {
+		t.Error("kept dir is stale")
+	}
+}
+
+func TestIsPostmaster(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("can't read process arguments on windows")
+	}
+	dir := t.TempDir()
+	cmd := exec.Command("sh", "-c", "sleep 10", "postgres", "-D", dir)
+	err := cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	pid := cmd.Process.Pid
+	pidFile := filepath.Join(dir, "postmaster.pid")
+	ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n%s\n", pid, dir)), 0600)
+	if !isPostmaster(pid, dir) {
+		t.Error("isPostmaster = false for the server's process")
+	}
+	if isPostmaster(os.Getpid(), dir) {
+		t.Error("isPostmaster = true for an unrelated process")
+	}
+	ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n/elsewhere\n", pid)), 0600)
+	if isPostmaster(pid, dir) {
+		t.Error("isPostmaster = true for a pid file naming another directory")
+	}
+}
@@ -0,0 +1,16 @@
+--
+-- A plain format dump, as made by pg_dump.
+--
+
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+
+CREATE TABLE public.widgets (
+    id integer NOT NULL,
+    name text NOT NULL
+);
+
+COPY public.widgets (id, name) FROM stdin;
+1	sprocket
+2	gear
+\.
@@ -0,0 +1,18 @@
+package pgtest
+
+// tmpfsBase is a memory-backed directory
+// for UseTmpfs, or empty if there is none.
+const tmpfsBase = "/dev/shm"
+
+// tmpfsMin is how much free space tmpfsBase
+// needs for UseTmpfs to put a data directory there.
+const tmpfsMin = 256 << 20
+
+// tmpfsDir returns tmpfsBase if it exists and has
+// at least tmpfsMin bytes free, or else "".
+func tmpfsDir() string {
+	if free, ok := diskFree(tmpfsBase); !ok || free < tmpfsMin {
+		return ""
+	}
+	return tmpfsBase
+}
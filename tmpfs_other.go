@@ -0,0 +1,7 @@
+//go:build !linux
+
+package pgtest
+
+const tmpfsBase = ""
+
+func tmpfsDir() string { return "" }